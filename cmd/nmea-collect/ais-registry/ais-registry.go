@@ -0,0 +1,184 @@
+package registry
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"calmh.dev/nmea-collect/internal/aisregistry"
+	"golang.org/x/exp/slices"
+)
+
+type CLI struct {
+	List   listCmd   `cmd:"" default:"withargs" help:"List vessels, most recently seen first"`
+	Search searchCmd `cmd:"" help:"Search vessels by MMSI, name or call sign"`
+	Export exportCmd `cmd:"" help:"Export the registry as CSV or JSON"`
+}
+
+type registryFlags struct {
+	Registry string `short:"r" default:"ais-registry.json" type:"path" help:"AIS registry file, as written by serve --ais-registry" placeholder:"FILE"`
+}
+
+func (f registryFlags) vessels() ([]aisregistry.Vessel, error) {
+	if _, err := os.Stat(f.Registry); err != nil {
+		return nil, err
+	}
+	reg, err := aisregistry.Open(f.Registry)
+	if err != nil {
+		return nil, err
+	}
+	return reg.Vessels(), nil
+}
+
+type listCmd struct {
+	registryFlags `embed:""`
+	Since         time.Duration `help:"Only vessels seen within this time" placeholder:"DURATION"`
+}
+
+func (cli *listCmd) Run() error {
+	vessels, err := cli.vessels()
+	if err != nil {
+		return err
+	}
+	if cli.Since > 0 {
+		cutoff := time.Now().Add(-cli.Since)
+		vessels = filter(vessels, func(v aisregistry.Vessel) bool {
+			return !v.LastSeen.Before(cutoff)
+		})
+	}
+	printTable(os.Stdout, vessels)
+	return nil
+}
+
+type searchCmd struct {
+	registryFlags `embed:""`
+	Query         string `arg:"" help:"Part of an MMSI, name or call sign, including previous names"`
+}
+
+func (cli *searchCmd) Run() error {
+	vessels, err := cli.vessels()
+	if err != nil {
+		return err
+	}
+	vessels = filter(vessels, func(v aisregistry.Vessel) bool {
+		return v.Matches(cli.Query)
+	})
+	printTable(os.Stdout, vessels)
+	return nil
+}
+
+type exportCmd struct {
+	registryFlags `embed:""`
+	Format        string `short:"f" enum:"csv,json" default:"csv" help:"Output format (csv, json)"`
+	Output        string `short:"o" type:"path" help:"Output file (default is standard output)" placeholder:"FILE"`
+}
+
+func (cli *exportCmd) Run() error {
+	vessels, err := cli.vessels()
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if cli.Output != "" {
+		fd, err := os.Create(cli.Output)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+		w = fd
+	}
+
+	switch cli.Format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(vessels)
+	default:
+		return writeCSV(w, vessels)
+	}
+}
+
+func filter(vessels []aisregistry.Vessel, keep func(aisregistry.Vessel) bool) []aisregistry.Vessel {
+	res := vessels[:0]
+	for _, v := range vessels {
+		if keep(v) {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func printTable(w io.Writer, vessels []aisregistry.Vessel) {
+	slices.SortFunc(vessels, func(a, b aisregistry.Vessel) bool {
+		return a.LastSeen.After(b.LastSeen)
+	})
+	tw := tabwriter.NewWriter(w, 2, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "MMSI\tClass\tName\tCall sign\tFirst seen\tLast seen\tMessages\tClosest\tMax range\n")
+	for _, v := range vessels {
+		var maxRange *float64
+		if v.MaxRangeNM > 0 {
+			maxRange = &v.MaxRangeNM
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			v.MMSI, v.Class, v.Name(), v.CallSign(),
+			v.FirstSeen.Local().Format("2006-01-02 15:04"),
+			v.LastSeen.Local().Format("2006-01-02 15:04"),
+			v.Messages, formatNM(v.ClosestNM), formatNM(maxRange))
+	}
+	tw.Flush()
+}
+
+func writeCSV(w io.Writer, vessels []aisregistry.Vessel) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"mmsi", "class", "name", "call_sign", "previous_names", "previous_call_signs", "first_seen", "last_seen", "messages", "closest_nm", "closest_time", "max_range_nm"})
+	for _, v := range vessels {
+		var closest, closestTime string
+		if v.ClosestNM != nil {
+			closest = strconv.FormatFloat(*v.ClosestNM, 'f', 2, 64)
+			closestTime = v.ClosestTime.UTC().Format(time.RFC3339)
+		}
+		_ = cw.Write([]string{
+			strconv.FormatUint(uint64(v.MMSI), 10),
+			v.Class,
+			v.Name(),
+			v.CallSign(),
+			previous(v.Names),
+			previous(v.CallSigns),
+			v.FirstSeen.UTC().Format(time.RFC3339),
+			v.LastSeen.UTC().Format(time.RFC3339),
+			strconv.FormatUint(v.Messages, 10),
+			closest,
+			closestTime,
+			strconv.FormatFloat(v.MaxRangeNM, 'f', 2, 64),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// previous returns the values before the current one, separated by
+// semicolons.
+func previous(hist []aisregistry.NameHistory) string {
+	if len(hist) < 2 {
+		return ""
+	}
+	vals := make([]string, 0, len(hist)-1)
+	for _, h := range hist[:len(hist)-1] {
+		vals = append(vals, h.Value)
+	}
+	return strings.Join(vals, ";")
+}
+
+func formatNM(v *float64) string {
+	if v == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f nm", *v)
+}
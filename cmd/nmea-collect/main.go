@@ -8,6 +8,7 @@ import (
 	"os/signal"
 	"syscall"
 
+	"calmh.dev/nmea-collect/cmd/nmea-collect/ais-registry"
 	"calmh.dev/nmea-collect/cmd/nmea-collect/consolidate-gzip"
 	"calmh.dev/nmea-collect/cmd/nmea-collect/serve"
 	"calmh.dev/nmea-collect/cmd/nmea-collect/summarize-gpx"
@@ -21,6 +22,7 @@ type CLI struct {
 	Serve           serve.CLI       `cmd:"" default:"" help:"Process incoming NMEA data"`
 	ConsolidateGzip consolidate.CLI `cmd:"" help:"Consolidate GZIP files"`
 	SummarizeGPX    summarize.CLI   `cmd:"" help:"Summarize GPX files"`
+	AISRegistry     registry.CLI    `cmd:"" name:"ais-registry" help:"List, search and export the AIS vessel registry"`
 }
 
 func main() {
@@ -0,0 +1,234 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/thejerf/suture/v4"
+	"gopkg.in/yaml.v3"
+)
+
+// adminAPI lets us inspect and change the pipeline at runtime:
+//
+//	GET    /admin/services                   list services and their state
+//	POST   /admin/{inputs,tees,outputs}      add a service, described as for the configuration file
+//	DELETE /admin/{inputs,tees,outputs}/NAME remove a service
+//	POST   /admin/{inputs,tees,outputs}/NAME/restart
+//
+// Request bodies are JSON or YAML. Services given on the command line are
+// listed but can't be changed.
+type adminAPI struct {
+	pipeline *pipeline
+	services func() []suture.Service // the static services
+	token    string
+}
+
+type adminServices struct {
+	Pipeline []pipelineServiceStatus `json:"pipeline"`
+	Static   []string                `json:"static"`
+}
+
+func (a *adminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin"), "/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case path == "services" && r.Method == http.MethodGet:
+		a.serveServices(w)
+
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		a.handle(w, a.add(parts[0], r.Body), http.StatusCreated)
+
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		a.handle(w, a.remove(parts[0], parts[1]), http.StatusNoContent)
+
+	case len(parts) == 3 && parts[2] == "restart" && r.Method == http.MethodPost:
+		kind, ok := adminKind(parts[0])
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		a.handle(w, a.pipeline.Restart(kind, parts[1]), http.StatusNoContent)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// adminLoopback returns true if the listen address only accepts
+// connections from the local host, so that the admin API may do without a
+// token.
+func adminLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (a *adminAPI) authorized(r *http.Request) bool {
+	if a.token == "" {
+		return true
+	}
+	auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(auth), []byte(a.token)) == 1
+}
+
+func (a *adminAPI) handle(w http.ResponseWriter, err error, status int) {
+	switch {
+	case err == nil:
+		w.WriteHeader(status)
+	case errors.Is(err, errPipelineNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func (a *adminAPI) serveServices(w http.ResponseWriter) {
+	res := adminServices{Pipeline: a.pipeline.Status(time.Now()), Static: []string{}}
+	for _, svc := range a.services() {
+		if svc == suture.Service(a.pipeline) {
+			continue
+		}
+		res.Static = append(res.Static, fmt.Sprint(svc))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+func (a *adminAPI) add(kinds string, body io.Reader) error {
+	bs, err := io.ReadAll(io.LimitReader(body, 1<<20))
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(bs))
+	dec.KnownFields(true)
+
+	switch kinds {
+	case "inputs":
+		var in pipelineInput
+		if err := dec.Decode(&in); err != nil {
+			return err
+		}
+		return a.pipeline.Update(func(cfg *pipelineConfig) error {
+			cfg.Inputs = append(cfg.Inputs, in)
+			return nil
+		})
+	case "tees":
+		var t pipelineTee
+		if err := dec.Decode(&t); err != nil {
+			return err
+		}
+		return a.pipeline.Update(func(cfg *pipelineConfig) error {
+			cfg.Tees = append(cfg.Tees, t)
+			return nil
+		})
+	case "outputs":
+		var o pipelineOutput
+		if err := dec.Decode(&o); err != nil {
+			return err
+		}
+		return a.pipeline.Update(func(cfg *pipelineConfig) error {
+			cfg.Outputs = append(cfg.Outputs, o)
+			return nil
+		})
+	default:
+		return errPipelineNotFound
+	}
+}
+
+func (a *adminAPI) remove(kinds, name string) error {
+	return a.pipeline.Update(func(cfg *pipelineConfig) error {
+		switch kinds {
+		case "inputs":
+			return removeNamed(&cfg.Inputs, name, func(in pipelineInput) string { return in.Name })
+		case "tees":
+			return removeNamed(&cfg.Tees, name, func(t pipelineTee) string { return t.Name })
+		case "outputs":
+			return removeNamed(&cfg.Outputs, name, func(o pipelineOutput) string { return o.Name })
+		default:
+			return errPipelineNotFound
+		}
+	})
+}
+
+func removeNamed[T any](s *[]T, name string, nameOf func(T) string) error {
+	for i, v := range *s {
+		if nameOf(v) == name {
+			*s = append((*s)[:i:i], (*s)[i+1:]...)
+			return nil
+		}
+	}
+	return errPipelineNotFound
+}
+
+// adminKind returns the service kind for the path element.
+func adminKind(kinds string) (string, bool) {
+	switch kinds {
+	case "inputs":
+		return "input", true
+	case "tees":
+		return "tee", true
+	case "outputs":
+		return "output", true
+	default:
+		return "", false
+	}
+}
+
+// adminListener serves the admin API on its own address.
+type adminListener struct {
+	addr    string
+	handler http.Handler
+}
+
+func (l *adminListener) String() string {
+	return fmt.Sprintf("admin-listener(%s)@%p", l.addr, l)
+}
+
+func (l *adminListener) Serve(ctx context.Context) error {
+	list, err := net.Listen("tcp", l.addr)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Handler:           l.handler,
+		ReadHeaderTimeout: 15 * time.Second,
+	}
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- srv.Serve(list)
+	}()
+
+	select {
+	case err := <-errC:
+		return err
+	case <-ctx.Done():
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(sctx)
+		return ctx.Err()
+	}
+}
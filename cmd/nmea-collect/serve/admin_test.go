@@ -0,0 +1,120 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/thejerf/suture/v4"
+	"golang.org/x/exp/slog"
+)
+
+func TestAdminAPI(t *testing.T) {
+	cfgFile := filepath.Join(t.TempDir(), "pipeline.yaml")
+	if err := os.WriteFile(cfgFile, []byte("outputs:\n  - name: laptop\n    type: udp\n    addrs: [127.0.0.1:10110]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadPipelineConfig(cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := make(chan *Message)
+	main := NewTee("main", input)
+	pl := newPipeline(input, main, slog.Default(), cfgFile, true)
+	if err := pl.Apply(cfg); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = main.Serve(ctx) }()
+	go func() { _ = pl.Serve(ctx) }()
+
+	admin := &adminAPI{pipeline: pl, services: func() []suture.Service { return []suture.Service{main, pl} }, token: "secret"}
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+		return rec
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/services", nil)
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("missing token should be unauthorized, got %d", rec.Code)
+	}
+
+	if rec := do(http.MethodPost, "/admin/outputs", `{"name": "aggregator", "type": "udp", "addrs": ["127.0.0.1:5321"], "max-delay": "10s"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("add: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodPost, "/admin/outputs", `{"name": "aggregator", "type": "udp", "addrs": ["127.0.0.1:5321"]}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("duplicate add should fail, got %d", rec.Code)
+	}
+
+	rec = do(http.MethodGet, "/admin/services", "")
+	var res adminServices
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Pipeline) != 2 || res.Pipeline[1].Name != "aggregator" || res.Pipeline[1].Queue == nil || res.Pipeline[1].State != "running" {
+		t.Errorf("unexpected services: %+v", res.Pipeline)
+	}
+	if len(res.Static) != 1 {
+		t.Errorf("unexpected static services: %v", res.Static)
+	}
+
+	laptop := pl.running["output/laptop"]
+	if rec := do(http.MethodPost, "/admin/outputs/laptop/restart", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("restart: %d %s", rec.Code, rec.Body)
+	}
+	if pl.running["output/laptop"] == laptop {
+		t.Error("output should have been restarted")
+	}
+
+	if rec := do(http.MethodDelete, "/admin/outputs/laptop", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("remove: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodDelete, "/admin/outputs/laptop", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("second remove should be not found, got %d", rec.Code)
+	}
+
+	saved, err := loadPipelineConfig(cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Outputs) != 1 || saved.Outputs[0].Name != "aggregator" || saved.Outputs[0].MaxDelay.String() != "10s" {
+		t.Errorf("unexpected saved config: %+v", saved)
+	}
+
+	// Secrets aren't shown.
+	if rec := do(http.MethodPost, "/admin/inputs", `{"name": "phone", "type": "http", "addr": "0", "token": "hunter2"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("add: %d %s", rec.Code, rec.Body)
+	}
+	rec = do(http.MethodGet, "/admin/services", "")
+	if body := rec.Body.String(); strings.Contains(body, "hunter2") || !strings.Contains(body, "REDACTED") {
+		t.Errorf("token should be redacted: %s", body)
+	}
+}
+
+func TestAdminLoopback(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"127.0.0.1:9140":  true,
+		"[::1]:9140":      true,
+		"localhost:9140":  true,
+		":9140":           false,
+		"0.0.0.0:9140":    false,
+		"172.16.1.2:9140": false,
+		"9140":            false,
+	} {
+		if got := adminLoopback(addr); got != want {
+			t.Errorf("adminLoopback(%q) == %v, want %v", addr, got, want)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BertoldVdb/go-ais"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/exp/slog"
+)
+
+var (
+	aisAlertMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nmea",
+		Subsystem: "ais",
+		Name:      "alert_messages_total",
+	}, []string{"kind"})
+	aisAlertHookErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nmea",
+		Subsystem: "ais",
+		Name:      "alert_hook_errors_total",
+	}, []string{"hook"})
+)
+
+// aisAlertKinds are the kinds of alerts, in metric label order. Distress
+// devices in test mode are reported as a kind of their own, e.g.
+// "sart_test".
+var aisAlertKinds = []string{"sart", "mob", "epirb", "sart_test", "mob_test", "epirb_test", "safety_addressed", "safety_broadcast"}
+
+const aisAlertHookTimeout = 10 * time.Second
+
+// aisAlert is a received safety related message or a message from a
+// distress device.
+type aisAlert struct {
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"`
+	MMSI     uint32    `json:"mmsi"`
+	Name     string    `json:"name,omitempty"`
+	Lat      *float64  `json:"lat,omitempty"`
+	Lon      *float64  `json:"lon,omitempty"`
+	Text     string    `json:"text,omitempty"`
+	DestMMSI uint32    `json:"dest_mmsi,omitempty"`
+	Source   string    `json:"source"`
+	Raw      string    `json:"raw"`
+
+	received time.Time // for repeat suppression, as Time may be from a tag block
+}
+
+// aisAlertMonitor looks for AIS safety messages (types 12 and 14) and
+// messages from AIS-SART, MOB and EPIRB devices. Each such message is
+// counted and appended to the events file. Logging and the hooks happen
+// at most once per repeat interval and MMSI, as distress devices transmit
+// in bursts.
+type aisAlertMonitor struct {
+	c          <-chan *Message
+	targets    *aisTargets
+	eventsFile string
+	webhook    string
+	execHook   string
+	repeat     time.Duration
+
+	alerted map[string]time.Time // kind and MMSI -> last alerted
+}
+
+func monitorAISAlerts(c <-chan *Message, targets *aisTargets, eventsFile, webhook, execHook string, repeat time.Duration) *aisAlertMonitor {
+	return &aisAlertMonitor{
+		c:          c,
+		targets:    targets,
+		eventsFile: eventsFile,
+		webhook:    webhook,
+		execHook:   execHook,
+		repeat:     repeat,
+		alerted:    make(map[string]time.Time),
+	}
+}
+
+func (m *aisAlertMonitor) String() string {
+	return fmt.Sprintf("ais-alert-monitor@%p", m)
+}
+
+func (m *aisAlertMonitor) Serve(ctx context.Context) error {
+	for _, kind := range aisAlertKinds {
+		aisAlertMessages.WithLabelValues(kind)
+	}
+	aisAlertHookErrors.WithLabelValues("webhook")
+	aisAlertHookErrors.WithLabelValues("exec")
+
+	for {
+		select {
+		case msg := <-m.c:
+			if msg.OwnVessel() {
+				continue
+			}
+			pkt := msg.AIS()
+			if pkt == nil {
+				continue
+			}
+			alert, ok := m.alertFor(pkt, msg)
+			if !ok {
+				continue
+			}
+			aisAlertMessages.WithLabelValues(alert.Kind).Inc()
+			if m.eventsFile != "" {
+				if err := m.persist(alert); err != nil {
+					slog.Error("Writing AIS alert event", "file", m.eventsFile, "error", err)
+				}
+			}
+			if m.shouldAlert(alert) {
+				m.alert(ctx, alert)
+			}
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// alertFor returns the alert for the packet, if it's one.
+func (m *aisAlertMonitor) alertFor(pkt ais.Packet, msg *Message) (aisAlert, bool) {
+	mmsi := pkt.GetHeader().UserID
+	alert := aisAlert{Time: msg.Time(), MMSI: mmsi, Source: msg.Source, Raw: msg.Line(), received: msg.Received}
+
+	switch p := pkt.(type) {
+	case ais.AddessedSafetyMessage:
+		alert.Kind = "safety_addressed"
+		alert.Text = aisString(p.Text)
+		alert.DestMMSI = p.DestinationID
+	case ais.SafetyBroadcastMessage:
+		alert.Kind = "safety_broadcast"
+		alert.Text = aisString(p.Text)
+	}
+	if kind := aisDistressDevice(mmsi); kind != "" {
+		// Distress devices also send safety broadcasts, such as "SART
+		// ACTIVE", which we report as coming from the device.
+		alert.Kind = kind
+		if aisDeviceTest(pkt) {
+			alert.Kind = kind + "_test"
+		}
+	}
+	if alert.Kind == "" {
+		return aisAlert{}, false
+	}
+
+	if lat, lon, ok := aisPacketPosition(pkt); ok {
+		alert.Lat, alert.Lon = &lat, &lon
+	}
+	if m.targets != nil {
+		if tgt, ok := m.targets.Target(mmsi); ok {
+			alert.Name = tgt.Name
+			if alert.Lat == nil && tgt.Position != nil {
+				alert.Lat, alert.Lon = &tgt.Position.Lat, &tgt.Position.Lon
+			}
+		}
+	}
+	return alert, true
+}
+
+func (m *aisAlertMonitor) shouldAlert(alert aisAlert) bool {
+	key := alert.Kind + "/" + strconv.FormatUint(uint64(alert.MMSI), 10)
+	if last, ok := m.alerted[key]; ok && alert.received.Sub(last) < m.repeat {
+		return false
+	}
+	m.alerted[key] = alert.received
+	for k, last := range m.alerted {
+		if alert.received.Sub(last) > m.repeat {
+			delete(m.alerted, k)
+		}
+	}
+	return true
+}
+
+func (m *aisAlertMonitor) alert(ctx context.Context, alert aisAlert) {
+	attrs := []any{"kind", alert.Kind, "mmsi", alert.MMSI}
+	if alert.Name != "" {
+		attrs = append(attrs, "name", alert.Name)
+	}
+	if alert.Lat != nil {
+		attrs = append(attrs, "lat", *alert.Lat, "lon", *alert.Lon)
+	}
+	if alert.Text != "" {
+		attrs = append(attrs, "text", alert.Text)
+	}
+	if alert.DestMMSI != 0 {
+		attrs = append(attrs, "dest_mmsi", alert.DestMMSI)
+	}
+	switch alert.Kind {
+	case "sart", "mob", "epirb":
+		slog.Error("AIS DISTRESS DEVICE", attrs...)
+	case "sart_test", "mob_test", "epirb_test":
+		// Routine device tests are logged, but don't call the hooks.
+		slog.Info("AIS distress device test", attrs...)
+		return
+	default:
+		slog.Warn("AIS safety message", attrs...)
+	}
+
+	bs, err := json.Marshal(alert)
+	if err != nil {
+		return
+	}
+	if m.webhook != "" {
+		go func() {
+			if err := postAlert(ctx, m.webhook, bs); err != nil {
+				slog.Error("AIS alert webhook", "url", m.webhook, "error", err)
+				aisAlertHookErrors.WithLabelValues("webhook").Inc()
+			}
+		}()
+	}
+	if m.execHook != "" {
+		go func() {
+			if err := execAlert(ctx, m.execHook, alert, bs); err != nil {
+				slog.Error("AIS alert exec hook", "cmd", m.execHook, "error", err)
+				aisAlertHookErrors.WithLabelValues("exec").Inc()
+			}
+		}()
+	}
+}
+
+// persist appends the alert as a JSON line to the events file.
+func (m *aisAlertMonitor) persist(alert aisAlert) error {
+	bs, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	_ = os.MkdirAll(filepath.Dir(m.eventsFile), 0o755)
+	fd, err := os.OpenFile(m.eventsFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := fd.Write(append(bs, '\n')); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+func postAlert(ctx context.Context, url string, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, aisAlertHookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// execAlert runs the command with the alert as JSON on stdin, and the
+// main fields in the environment. The command is split into program and
+// arguments on white space, without any shell quoting.
+func execAlert(ctx context.Context, command string, alert aisAlert, body []byte) error {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return errors.New("empty command")
+	}
+	ctx, cancel := context.WithTimeout(ctx, aisAlertHookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(),
+		"AIS_ALERT_KIND="+alert.Kind,
+		"AIS_ALERT_MMSI="+strconv.FormatUint(uint64(alert.MMSI), 10),
+		"AIS_ALERT_NAME="+alert.Name,
+		"AIS_ALERT_TEXT="+alert.Text,
+	)
+	if alert.Lat != nil {
+		cmd.Env = append(cmd.Env,
+			"AIS_ALERT_LAT="+strconv.FormatFloat(*alert.Lat, 'f', -1, 64),
+			"AIS_ALERT_LON="+strconv.FormatFloat(*alert.Lon, 'f', -1, 64),
+		)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// aisDeviceTest returns true if the packet from a distress device says
+// it's in test mode, per IEC 61097-14: navigational status 15 rather than
+// 14 (AIS-SART active), or a safety broadcast such as "SART TEST" rather
+// than "SART ACTIVE".
+func aisDeviceTest(pkt ais.Packet) bool {
+	switch p := pkt.(type) {
+	case ais.PositionReport:
+		return p.NavigationalStatus == 15
+	case ais.SafetyBroadcastMessage:
+		return strings.Contains(aisString(p.Text), "TEST")
+	default:
+		return false
+	}
+}
+
+// aisDistressDevice returns the kind of distress device the MMSI belongs
+// to, if any, per ITU-R M.585.
+func aisDistressDevice(mmsi uint32) string {
+	switch mmsi / 1000000 {
+	case 970:
+		return "sart"
+	case 972:
+		return "mob"
+	case 974:
+		return "epirb"
+	default:
+		return ""
+	}
+}
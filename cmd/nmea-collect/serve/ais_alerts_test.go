@@ -0,0 +1,116 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BertoldVdb/go-ais"
+)
+
+func TestAISAlertFor(t *testing.T) {
+	m := monitorAISAlerts(nil, nil, "", "", "", 10*time.Minute)
+	msg := &Message{Source: "test", Received: time.Now()}
+
+	cases := []struct {
+		pkt  ais.Packet
+		kind string
+		text string
+	}{
+		{ais.PositionReport{Header: ais.Header{MessageID: 1, UserID: 970123456}, NavigationalStatus: 14, Latitude: 57, Longitude: 11}, "sart", ""},
+		{ais.PositionReport{Header: ais.Header{MessageID: 1, UserID: 970123456}, NavigationalStatus: 15, Latitude: 57, Longitude: 11}, "sart_test", ""},
+		{ais.SafetyBroadcastMessage{Header: ais.Header{MessageID: 14, UserID: 970123456}, Text: "SART TEST@@@"}, "sart_test", "SART TEST"},
+		{ais.SafetyBroadcastMessage{Header: ais.Header{MessageID: 14, UserID: 972123456}, Text: "MOB ACTIVE@@@"}, "mob", "MOB ACTIVE"},
+		{ais.SafetyBroadcastMessage{Header: ais.Header{MessageID: 14, UserID: 265123456}, Text: "NAV WARNING"}, "safety_broadcast", "NAV WARNING"},
+		{ais.AddessedSafetyMessage{Header: ais.Header{MessageID: 12, UserID: 265123456}, DestinationID: 265654321, Text: "HELLO"}, "safety_addressed", "HELLO"},
+		{ais.PositionReport{Header: ais.Header{MessageID: 1, UserID: 265123456}, Latitude: 57, Longitude: 11}, "", ""},
+	}
+	for _, tc := range cases {
+		alert, ok := m.alertFor(tc.pkt, msg)
+		if ok != (tc.kind != "") || alert.Kind != tc.kind || alert.Text != tc.text {
+			t.Errorf("%T from %d: got %v %q %q, want %q %q", tc.pkt, tc.pkt.GetHeader().UserID, ok, alert.Kind, alert.Text, tc.kind, tc.text)
+		}
+	}
+}
+
+func TestAISAlertHooks(t *testing.T) {
+	posted := make(chan aisAlert, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert aisAlert
+		bs, _ := io.ReadAll(r.Body)
+		_ = json.Unmarshal(bs, &alert)
+		posted <- alert
+	}))
+	defer srv.Close()
+
+	events := filepath.Join(t.TempDir(), "events.jsonl")
+	c := make(chan *Message, 10)
+	m := monitorAISAlerts(c, nil, events, srv.URL, "", 10*time.Minute)
+
+	// Position report from MMSI 970123456, an AIS-SART.
+	sart := "!AIVDM,1,1,,A,1>M;`h>P00PjFb0PWIh>4?wp0000,0*03"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Serve(ctx)
+
+	t0 := time.Now()
+	for i := 0; i < 3; i++ {
+		msg := acceptLine("test", sart)
+		if msg == nil {
+			t.Fatal("line not accepted")
+		}
+		msg.Received = t0.Add(time.Duration(i) * time.Second)
+		c <- msg
+	}
+
+	select {
+	case alert := <-posted:
+		if alert.Kind != "sart" || alert.MMSI/1000000 != 970 {
+			t.Errorf("unexpected alert: %+v", alert)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook call")
+	}
+
+	// All messages are persisted, but only the first is alerted.
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		bs, _ := os.ReadFile(events)
+		if strings.Count(string(bs), "\n") == 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	bs, _ := os.ReadFile(events)
+	if n := strings.Count(string(bs), "\n"); n != 3 {
+		t.Errorf("expected three events, got %d", n)
+	}
+	select {
+	case alert := <-posted:
+		t.Errorf("unexpected repeated alert: %+v", alert)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAISAlertExec(t *testing.T) {
+	// The command gets its arguments, and the alert on stdin.
+	out := filepath.Join(t.TempDir(), "alert.json")
+	body := []byte(`{"kind":"sart"}`)
+	if err := execAlert(context.Background(), "cp /dev/stdin "+out, aisAlert{Kind: "sart"}, body); err != nil {
+		t.Fatal(err)
+	}
+	if bs, _ := os.ReadFile(out); string(bs) != string(body) {
+		t.Errorf("got %q, expected %q", bs, body)
+	}
+
+	if err := execAlert(context.Background(), " ", aisAlert{}, nil); err == nil {
+		t.Error("expected error for empty command")
+	}
+}
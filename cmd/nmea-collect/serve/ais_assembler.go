@@ -0,0 +1,171 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/BertoldVdb/go-ais"
+	nmea "github.com/adrianmo/go-nmea"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	aisFragmentsInput = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "nmea",
+		Subsystem: "ais",
+		Name:      "fragments_input_total",
+	})
+	aisFragmentsAssembled = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "nmea",
+		Subsystem: "ais",
+		Name:      "fragments_assembled_messages_total",
+	})
+	aisFragmentsOrphaned = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nmea",
+		Subsystem: "ais",
+		Name:      "fragments_orphaned_total",
+	}, []string{"reason"})
+	aisFragmentsPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nmea",
+		Subsystem: "ais",
+		Name:      "fragments_pending_messages",
+	})
+)
+
+// aisFragmentKey identifies a multi-sentence AIS message being assembled.
+type aisFragmentKey struct {
+	source  string
+	typ     string
+	channel string
+	seq     int64
+}
+
+type aisFragments struct {
+	total    int64
+	next     int64
+	payload  []byte
+	header   *ais.Header
+	lastSeen time.Time
+}
+
+// aisAssembler passes messages on unchanged, except that the last sentence
+// of a complete multi-sentence AIS message also carries the assembled
+// payload, making the full AIS packet available to every consumer. Every
+// sentence of the message carries the header, so that filters can pass or
+// drop all of them together.
+type aisAssembler struct {
+	input   <-chan *Message
+	output  chan<- *Message
+	timeout time.Duration
+	pending map[aisFragmentKey]*aisFragments
+}
+
+func assembleAIS(input <-chan *Message, output chan<- *Message, timeout time.Duration) *aisAssembler {
+	return &aisAssembler{
+		input:   input,
+		output:  output,
+		timeout: timeout,
+	}
+}
+
+func (a *aisAssembler) String() string {
+	return fmt.Sprintf("ais-assembler@%p", a)
+}
+
+func (a *aisAssembler) Serve(ctx context.Context) error {
+	a.pending = make(map[aisFragmentKey]*aisFragments)
+	aisFragmentsOrphaned.WithLabelValues("timeout")
+	aisFragmentsOrphaned.WithLabelValues("sequence")
+
+	expireTicker := time.NewTicker(a.timeout / 2)
+	defer expireTicker.Stop()
+
+	for {
+		select {
+		case msg := <-a.input:
+			a.process(msg)
+			select {
+			case a.output <- msg:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+		case <-expireTicker.C:
+			a.expire(time.Now())
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (a *aisAssembler) process(msg *Message) {
+	if len(msg.Raw) == 0 || msg.Raw[0] != '!' {
+		return
+	}
+	sent, err := msg.Sentence()
+	if err != nil {
+		return
+	}
+	vdmvdo, ok := sent.(nmea.VDMVDO)
+	if !ok || vdmvdo.NumFragments < 2 {
+		return
+	}
+	aisFragmentsInput.Inc()
+
+	key := aisFragmentKey{
+		source:  msg.Source,
+		typ:     vdmvdo.DataType(),
+		channel: vdmvdo.Channel,
+		seq:     vdmvdo.MessageID,
+	}
+	frags := a.pending[key]
+
+	if vdmvdo.FragmentNumber == 1 {
+		if frags != nil {
+			// A new message started before the previous one with the
+			// same key was complete.
+			aisFragmentsOrphaned.WithLabelValues("sequence").Add(float64(frags.next - 1))
+		}
+		frags = &aisFragments{total: vdmvdo.NumFragments, next: 1}
+		if hdr, ok := aisPayloadHeader(vdmvdo.Payload); ok {
+			frags.header = &hdr
+		}
+		a.pending[key] = frags
+	} else if frags == nil || frags.next != vdmvdo.FragmentNumber || frags.total != vdmvdo.NumFragments {
+		orphans := int64(1)
+		if frags != nil {
+			orphans += frags.next - 1
+			delete(a.pending, key)
+		}
+		aisFragmentsOrphaned.WithLabelValues("sequence").Add(float64(orphans))
+		aisFragmentsPending.Set(float64(len(a.pending)))
+		return
+	}
+
+	frags.payload = append(frags.payload, vdmvdo.Payload...)
+	msg.aisHeader = frags.header
+	frags.lastSeen = time.Now()
+	frags.next++
+
+	if vdmvdo.FragmentNumber == vdmvdo.NumFragments {
+		msg.aisPayload = frags.payload
+		delete(a.pending, key)
+		aisFragmentsAssembled.Inc()
+	}
+	aisFragmentsPending.Set(float64(len(a.pending)))
+}
+
+// expire drops incomplete messages that haven't seen a new fragment
+// within the timeout.
+func (a *aisAssembler) expire(now time.Time) {
+	for key, frags := range a.pending {
+		if now.Sub(frags.lastSeen) > a.timeout {
+			aisFragmentsOrphaned.WithLabelValues("timeout").Add(float64(frags.next - 1))
+			delete(a.pending, key)
+		}
+	}
+	aisFragmentsPending.Set(float64(len(a.pending)))
+}
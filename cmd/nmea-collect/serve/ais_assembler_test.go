@@ -0,0 +1,59 @@
+package serve
+
+import (
+	"testing"
+	"time"
+
+	"github.com/BertoldVdb/go-ais"
+)
+
+func TestAISAssembler(t *testing.T) {
+	a := assembleAIS(nil, nil, time.Minute)
+	a.pending = make(map[aisFragmentKey]*aisFragments)
+
+	first := acceptLine("test", "!AIVDM,2,1,4,B,55WilF81SCLtcP;;K?9<4r18Dlv20000000000166pA7453V0:21C31,0*5D")
+	second := acceptLine("test", "!AIVDM,2,2,4,B,BjDh000000000000,2*17")
+	a.process(first)
+	a.process(second)
+
+	if first.AIS() != nil {
+		t.Error("first fragment should not have a packet")
+	}
+	pkt, ok := second.AIS().(ais.ShipStaticData)
+	if !ok {
+		t.Fatalf("expected static data, got %T", second.AIS())
+	}
+	if pkt.UserID == 0 || pkt.Name == "" {
+		t.Error("bad static data", pkt)
+	}
+	if len(a.pending) != 0 {
+		t.Error("nothing should be pending")
+	}
+}
+
+func TestAISAssemblerOrphans(t *testing.T) {
+	a := assembleAIS(nil, nil, time.Minute)
+	a.pending = make(map[aisFragmentKey]*aisFragments)
+
+	// A lone second fragment is dropped
+	second := acceptLine("test", "!AIVDM,2,2,4,B,BjDh000000000000,2*17")
+	a.process(second)
+	if second.AIS() != nil || len(a.pending) != 0 {
+		t.Error("lone second fragment should be dropped")
+	}
+
+	// Fragments from different sources don't mix
+	first := acceptLine("one", "!AIVDM,2,1,4,B,55WilF81SCLtcP;;K?9<4r18Dlv20000000000166pA7453V0:21C31,0*5D")
+	second = acceptLine("two", "!AIVDM,2,2,4,B,BjDh000000000000,2*17")
+	a.process(first)
+	a.process(second)
+	if second.AIS() != nil {
+		t.Error("fragments from different sources should not be assembled")
+	}
+
+	// The incomplete message expires
+	a.expire(time.Now().Add(2 * time.Minute))
+	if len(a.pending) != 0 {
+		t.Error("incomplete message should expire")
+	}
+}
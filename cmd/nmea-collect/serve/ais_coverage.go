@@ -0,0 +1,328 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"calmh.dev/nmea-collect/internal/geometry"
+	"github.com/BertoldVdb/go-ais"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	aisCoverageRange = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nmea",
+		Subsystem: "ais",
+		Name:      "coverage_range_nm",
+	}, []string{"sector", "stat"})
+	aisCoveragePositions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "nmea",
+		Subsystem: "ais",
+		Name:      "coverage_positions_total",
+	})
+	aisCoverageIgnored = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nmea",
+		Subsystem: "ais",
+		Name:      "coverage_positions_ignored_total",
+	}, []string{"reason"})
+)
+
+const (
+	coverageWindow     = 24 * time.Hour
+	coverageBucketSize = time.Hour
+	coverageSectors    = 12   // 30° sectors for the metrics
+	coveragePolarBins  = 72   // 5° bins for the coverage polygon
+	coverageBinNM      = 0.5  // resolution of the range histograms
+	coverageMaxRange   = 250. // positions further away are taken as bogus
+	coverageRangeBins  = int(coverageMaxRange / coverageBinNM)
+	coverageInterval   = time.Minute
+)
+
+// coverageStats are the names and quantiles of the published range
+// statistics, in addition to the maximum.
+var coverageStats = []struct {
+	name string
+	q    float64
+}{
+	{"p50", 0.5},
+	{"p90", 0.9},
+	{"p99", 0.99},
+}
+
+// coverageHist is a histogram of reception ranges.
+type coverageHist struct {
+	counts [coverageRangeBins]uint32
+	n      int
+	max    float64
+}
+
+func (h *coverageHist) observe(rng float64) {
+	bin := int(rng / coverageBinNM)
+	if bin >= coverageRangeBins {
+		bin = coverageRangeBins - 1
+	}
+	h.counts[bin]++
+	h.n++
+	if rng > h.max {
+		h.max = rng
+	}
+}
+
+func (h *coverageHist) merge(o *coverageHist) {
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	h.n += o.n
+	if o.max > h.max {
+		h.max = o.max
+	}
+}
+
+// quantile returns the upper edge of the bin containing the given
+// quantile, but never more than the maximum observed range.
+func (h *coverageHist) quantile(q float64) float64 {
+	if h.n == 0 {
+		return 0
+	}
+	target := q * float64(h.n)
+	var cum float64
+	for i, c := range h.counts {
+		cum += float64(c)
+		if cum >= target {
+			edge := float64(i+1) * coverageBinNM
+			if edge > h.max {
+				return h.max
+			}
+			return edge
+		}
+	}
+	return h.max
+}
+
+// coverageBucket holds the observations for one hour.
+type coverageBucket struct {
+	start   time.Time
+	sectors [coverageSectors]coverageHist
+	polar   [coveragePolarBins]float64 // max range per bin
+}
+
+// aisCoverage records the range and bearing from our own position to
+// received AIS position reports, over the last 24 hours.
+type aisCoverage struct {
+	c   <-chan *Message
+	own *ownShip
+
+	mut     sync.Mutex
+	buckets []*coverageBucket
+	center  *ownShipFix // own position at the latest observation
+}
+
+func newAISCoverage(c <-chan *Message, own *ownShip) *aisCoverage {
+	return &aisCoverage{c: c, own: own}
+}
+
+func (a *aisCoverage) String() string {
+	return fmt.Sprintf("ais-coverage@%p", a)
+}
+
+func (a *aisCoverage) Serve(ctx context.Context) error {
+	aisCoverageIgnored.WithLabelValues("no_own_position")
+	aisCoverageIgnored.WithLabelValues("out_of_range")
+
+	ticker := time.NewTicker(coverageInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg := <-a.c:
+			if msg.OwnVessel() {
+				continue
+			}
+			pkt := msg.AIS()
+			if pkt == nil {
+				continue
+			}
+			lat, lon, ok := aisPacketPosition(pkt)
+			if !ok {
+				continue
+			}
+			fix, ok := a.own.Fix(msg.Received)
+			if !ok {
+				aisCoverageIgnored.WithLabelValues("no_own_position").Inc()
+				continue
+			}
+			rng := geometry.Distance(fix.Lat, fix.Lon, lat, lon)
+			if rng > coverageMaxRange {
+				aisCoverageIgnored.WithLabelValues("out_of_range").Inc()
+				continue
+			}
+			a.observe(msg.Received, fix, geometry.Bearing(fix.Lat, fix.Lon, lat, lon), rng)
+			aisCoveragePositions.Inc()
+
+		case <-ticker.C:
+			a.account(time.Now())
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (a *aisCoverage) observe(when time.Time, fix ownShipFix, bearing, rng float64) {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+
+	start := when.Truncate(coverageBucketSize)
+	var bucket *coverageBucket
+	for i := len(a.buckets) - 1; i >= 0; i-- {
+		if a.buckets[i].start.Equal(start) {
+			bucket = a.buckets[i]
+			break
+		}
+		if a.buckets[i].start.Before(start) {
+			break
+		}
+	}
+	if bucket == nil {
+		if len(a.buckets) > 0 && start.Before(a.buckets[len(a.buckets)-1].start) {
+			// Too old, or a gap we don't have a bucket for.
+			return
+		}
+		bucket = &coverageBucket{start: start}
+		a.buckets = append(a.buckets, bucket)
+		a.expire(when)
+	}
+
+	bucket.sectors[int(bearing/(360/coverageSectors))%coverageSectors].observe(rng)
+	bin := int(bearing/(360/coveragePolarBins)) % coveragePolarBins
+	if rng > bucket.polar[bin] {
+		bucket.polar[bin] = rng
+	}
+	a.center = &fix
+}
+
+// expire removes buckets that are entirely outside the window.
+func (a *aisCoverage) expire(now time.Time) {
+	cutoff := now.Add(-coverageWindow)
+	for len(a.buckets) > 0 && !a.buckets[0].start.Add(coverageBucketSize).After(cutoff) {
+		a.buckets = a.buckets[1:]
+	}
+}
+
+// sectors returns the merged histograms per sector and overall.
+func (a *aisCoverage) sectors() ([coverageSectors]coverageHist, coverageHist) {
+	var sectors [coverageSectors]coverageHist
+	var all coverageHist
+	for _, b := range a.buckets {
+		for i := range b.sectors {
+			sectors[i].merge(&b.sectors[i])
+			all.merge(&b.sectors[i])
+		}
+	}
+	return sectors, all
+}
+
+// account expires old data and updates the metrics.
+func (a *aisCoverage) account(now time.Time) {
+	a.mut.Lock()
+	a.expire(now)
+	sectors, all := a.sectors()
+	a.mut.Unlock()
+
+	set := func(sector string, h *coverageHist) {
+		aisCoverageRange.WithLabelValues(sector, "max").Set(h.max)
+		for _, s := range coverageStats {
+			aisCoverageRange.WithLabelValues(sector, s.name).Set(h.quantile(s.q))
+		}
+	}
+	set("all", &all)
+	for i := range sectors {
+		set(coverageSectorName(i), &sectors[i])
+	}
+}
+
+// ServeGeoJSON serves the maximum range per bearing over the last 24
+// hours as a polygon, drawn around our latest own position.
+func (a *aisCoverage) ServeGeoJSON(w http.ResponseWriter, r *http.Request) {
+	a.mut.Lock()
+	a.expire(time.Now())
+	var polar [coveragePolarBins]float64
+	for _, b := range a.buckets {
+		for i, v := range b.polar {
+			if v > polar[i] {
+				polar[i] = v
+			}
+		}
+	}
+	sectors, all := a.sectors()
+	center := a.center
+	a.mut.Unlock()
+
+	fc := geoJSONFeatureCollection{Type: "FeatureCollection", Features: []geoJSONFeature{}}
+	if center != nil {
+		props := map[string]any{
+			"window":    coverageWindow.String(),
+			"positions": all.n,
+			"max_nm":    all.max,
+		}
+		sectorMax := make(map[string]float64, coverageSectors)
+		for i := range sectors {
+			sectorMax[coverageSectorName(i)] = sectors[i].max
+		}
+		props["sector_max_nm"] = sectorMax
+
+		// RFC 7946 wants the exterior ring counterclockwise, that is,
+		// in order of decreasing bearing.
+		ring := make([][]float64, 0, coveragePolarBins+1)
+		for i := coveragePolarBins - 1; i >= 0; i-- {
+			bearing := (float64(i) + 0.5) * 360 / coveragePolarBins
+			lat, lon := geometry.Destination(center.Lat, center.Lon, bearing, polar[i])
+			ring = append(ring, []float64{lon, lat})
+		}
+		ring = append(ring, ring[0])
+
+		fc.Features = append(fc.Features, geoJSONFeature{
+			Type:       "Feature",
+			Geometry:   geoJSONGeometry{Type: "Polygon", Coordinates: [][][]float64{ring}},
+			Properties: props,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/geo+json")
+	_ = json.NewEncoder(w).Encode(fc)
+}
+
+// coverageSectorName returns the sector label, being the bearing where
+// the sector starts.
+func coverageSectorName(i int) string {
+	return fmt.Sprintf("%03d", i*360/coverageSectors)
+}
+
+// aisPacketPosition returns the reported position for packet types that
+// have one.
+func aisPacketPosition(pkt ais.Packet) (float64, float64, bool) {
+	var lat, lon float64
+	switch p := pkt.(type) {
+	case ais.PositionReport:
+		lat, lon = float64(p.Latitude), float64(p.Longitude)
+	case ais.StandardClassBPositionReport:
+		lat, lon = float64(p.Latitude), float64(p.Longitude)
+	case ais.ExtendedClassBPositionReport:
+		lat, lon = float64(p.Latitude), float64(p.Longitude)
+	case ais.BaseStationReport:
+		lat, lon = float64(p.Latitude), float64(p.Longitude)
+	case ais.StandardSearchAndRescueAircraftReport:
+		lat, lon = float64(p.Latitude), float64(p.Longitude)
+	default:
+		return 0, 0, false
+	}
+	if newAISPosition(lat, lon, -1, -1, -1, time.Time{}) == nil {
+		return 0, 0, false
+	}
+	return lat, lon, true
+}
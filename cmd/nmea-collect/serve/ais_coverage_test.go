@@ -0,0 +1,97 @@
+package serve
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCoverageHistQuantile(t *testing.T) {
+	var h coverageHist
+	for i := 1; i <= 100; i++ {
+		h.observe(float64(i) / 10)
+	}
+	if h.max != 10 {
+		t.Errorf("max = %f, want 10", h.max)
+	}
+	if q := h.quantile(0.5); q != 5.5 {
+		t.Errorf("p50 = %f, want 5.5", q)
+	}
+	if q := h.quantile(0.99); q != 10 {
+		t.Errorf("p99 = %f, want 10", q)
+	}
+}
+
+func TestAISCoverage(t *testing.T) {
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	fix := ownShipFix{Lat: 57, Lon: 11, Time: now}
+	a := newAISCoverage(nil, nil)
+
+	a.observe(now.Add(-30*time.Hour), fix, 10, 20)
+	a.observe(now.Add(-time.Hour), fix, 10, 5)
+	a.observe(now.Add(-time.Hour), fix, 100, 12)
+	a.observe(now, fix, 350, 8)
+	a.expire(now)
+
+	sectors, all := a.sectors()
+	if all.n != 3 || all.max != 12 {
+		t.Errorf("all: n = %d, max = %f, want 3 and 12", all.n, all.max)
+	}
+	if sectors[0].max != 5 || sectors[3].max != 12 || sectors[11].max != 8 {
+		t.Errorf("unexpected sector maximums: %f %f %f", sectors[0].max, sectors[3].max, sectors[11].max)
+	}
+
+	rec := httptest.NewRecorder()
+	a.ServeGeoJSON(rec, httptest.NewRequest("GET", "/ais/coverage.geojson", nil))
+	var fc struct {
+		Features []struct {
+			Geometry struct {
+				Type        string
+				Coordinates [][][]float64
+			}
+		}
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &fc); err != nil {
+		t.Fatal(err)
+	}
+	if len(fc.Features) != 1 || fc.Features[0].Geometry.Type != "Polygon" || len(fc.Features[0].Geometry.Coordinates[0]) != coveragePolarBins+1 {
+		t.Errorf("unexpected GeoJSON: %s", rec.Body.String())
+	}
+}
+
+func TestAISCoverageGeoJSONWinding(t *testing.T) {
+	now := time.Now()
+	fix := ownShipFix{Lat: 57, Lon: 11, Time: now}
+	a := newAISCoverage(nil, nil)
+	for b := 0; b < 360; b += 5 {
+		a.observe(now, fix, float64(b)+2.5, 1)
+	}
+
+	rec := httptest.NewRecorder()
+	a.ServeGeoJSON(rec, httptest.NewRequest("GET", "/ais/coverage.geojson", nil))
+	var fc struct {
+		Features []struct {
+			Geometry struct {
+				Coordinates [][][]float64
+			}
+		}
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &fc); err != nil {
+		t.Fatal(err)
+	}
+	if len(fc.Features) != 1 {
+		t.Fatalf("unexpected GeoJSON: %s", rec.Body.String())
+	}
+
+	// The exterior ring must be counterclockwise, that is, have a
+	// positive signed area.
+	var area float64
+	ring := fc.Features[0].Geometry.Coordinates[0]
+	for i := 0; i < len(ring)-1; i++ {
+		area += ring[i][0]*ring[i+1][1] - ring[i+1][0]*ring[i][1]
+	}
+	if area <= 0 {
+		t.Errorf("exterior ring is clockwise, signed area %g", area/2)
+	}
+}
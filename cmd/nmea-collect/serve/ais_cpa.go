@@ -0,0 +1,322 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"calmh.dev/nmea-collect/internal/geometry"
+	nmea "github.com/adrianmo/go-nmea"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/exp/slices"
+	"golang.org/x/exp/slog"
+)
+
+var (
+	aisCPAAlarms = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nmea",
+		Subsystem: "ais",
+		Name:      "cpa_alarms",
+	})
+	aisCPAAlarmsRaised = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "nmea",
+		Subsystem: "ais",
+		Name:      "cpa_alarms_raised_total",
+	})
+	aisCPADistance = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nmea",
+		Subsystem: "ais",
+		Name:      "cpa_distance_nm",
+	}, []string{"mmsi"})
+	aisCPATime = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nmea",
+		Subsystem: "ais",
+		Name:      "cpa_time_seconds",
+	}, []string{"mmsi"})
+)
+
+const (
+	cpaInterval      = 5 * time.Second
+	cpaMaxTargetAge  = 6 * time.Minute
+	cpaTalker        = "VR"
+	cpaSource        = "cpa"
+	cpaMaxTargetNums = 99
+)
+
+// cpaResult is the closest point of approach for one target.
+type cpaResult struct {
+	MMSI    uint32     `json:"mmsi"`
+	Name    string     `json:"name,omitempty"`
+	Range   float64    `json:"range_nm"`
+	Bearing float64    `json:"bearing"`
+	SOG     float64    `json:"sog"`
+	COG     float64    `json:"cog"`
+	CPA     float64    `json:"cpa_nm"`
+	TCPA    float64    `json:"tcpa_min"`
+	Alarm   bool       `json:"alarm"`
+	Since   *time.Time `json:"alarm_since,omitempty"`
+}
+
+type cpaAlarm struct {
+	num   int // target number for TTM/ALR, or zero if there are too many
+	since time.Time
+}
+
+// cpaMonitor periodically computes the closest point of approach for all
+// targets with a known position and course, and raises alarms for those
+// coming closer than the limit within the time horizon. Our own vessel,
+// should we hear our own transponder as a target, is left out. Alarms can
+// optionally be emitted as ALR or TTM sentences into the output channel.
+type cpaMonitor struct {
+	targets  *aisTargets
+	own      *ownShip
+	distance float64       // alarm limit, nautical miles
+	horizon  time.Duration // alarm limit, time to CPA
+	emit     string        // "alr", "ttm" or empty
+	output   chan<- *Message
+
+	mut     sync.Mutex
+	fix     *ownShipFix
+	results []cpaResult
+	alarms  map[uint32]*cpaAlarm
+}
+
+func newCPAMonitor(targets *aisTargets, own *ownShip, distance float64, horizon time.Duration, emit string, output chan<- *Message) *cpaMonitor {
+	return &cpaMonitor{
+		targets:  targets,
+		own:      own,
+		distance: distance,
+		horizon:  horizon,
+		emit:     emit,
+		output:   output,
+		alarms:   make(map[uint32]*cpaAlarm),
+	}
+}
+
+func (m *cpaMonitor) String() string {
+	return fmt.Sprintf("cpa-monitor@%p", m)
+}
+
+func (m *cpaMonitor) Serve(ctx context.Context) error {
+	if m.emit != "" {
+		registerInputMetrics(cpaSource)
+	}
+
+	ticker := time.NewTicker(cpaInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, line := range m.evaluate(time.Now()) {
+				msg := acceptLine(cpaSource, line)
+				if msg == nil {
+					continue
+				}
+				select {
+				case m.output <- msg:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// evaluate computes the CPA for all current targets, updates the alarm
+// state and metrics, and returns the sentences to emit.
+func (m *cpaMonitor) evaluate(now time.Time) []string {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	var results []cpaResult
+	fix, ok := m.own.Fix(now)
+	if ok {
+		// Dead reckon our own position to now, and the targets likewise
+		// below, so that they are compared at the same point in time.
+		lat, lon := geometry.Destination(fix.Lat, fix.Lon, fix.COG, fix.SOG*now.Sub(fix.Time).Hours())
+		ownMMSI := m.own.MMSI()
+		for _, tgt := range m.targets.Snapshot() {
+			if tgt.MMSI == ownMMSI {
+				continue
+			}
+			pos := tgt.Position
+			if pos == nil || pos.SOG == nil || pos.COG == nil || now.Sub(pos.Time) > cpaMaxTargetAge {
+				continue
+			}
+			if tgt.Class != "A" && tgt.Class != "B" && tgt.Class != "sar" {
+				continue
+			}
+			tlat, tlon := geometry.Destination(pos.Lat, pos.Lon, *pos.COG, *pos.SOG*now.Sub(pos.Time).Hours())
+			cpa, tcpa := geometry.CPA(lat, lon, fix.SOG, fix.COG, tlat, tlon, *pos.SOG, *pos.COG)
+			res := cpaResult{
+				MMSI:    tgt.MMSI,
+				Name:    tgt.Name,
+				Range:   geometry.Distance(lat, lon, tlat, tlon),
+				Bearing: geometry.Bearing(lat, lon, tlat, tlon),
+				SOG:     *pos.SOG,
+				COG:     *pos.COG,
+				CPA:     cpa,
+				TCPA:    tcpa * 60,
+			}
+			res.Alarm = cpa < m.distance && tcpa >= 0 && tcpa <= m.horizon.Hours()
+			results = append(results, res)
+		}
+		m.fix = &fix
+	} else {
+		m.fix = nil
+	}
+
+	var lines []string
+	active := make(map[uint32]bool)
+	aisCPADistance.Reset()
+	aisCPATime.Reset()
+	for i := range results {
+		res := &results[i]
+		if !res.Alarm {
+			continue
+		}
+		active[res.MMSI] = true
+		alarm, ok := m.alarms[res.MMSI]
+		if !ok {
+			alarm = &cpaAlarm{num: m.targetNumber(), since: now}
+			m.alarms[res.MMSI] = alarm
+			aisCPAAlarmsRaised.Inc()
+			slog.Warn("CPA alarm", "mmsi", res.MMSI, "name", res.Name, "cpa_nm", round(res.CPA, 2), "tcpa_min", round(res.TCPA, 1), "range_nm", round(res.Range, 2), "bearing", math.Round(res.Bearing))
+		}
+		res.Since = &alarm.since
+		mmsi := strconv.FormatUint(uint64(res.MMSI), 10)
+		aisCPADistance.WithLabelValues(mmsi).Set(res.CPA)
+		aisCPATime.WithLabelValues(mmsi).Set(res.TCPA * 60)
+		if alarm.num > 0 {
+			switch m.emit {
+			case "alr":
+				lines = append(lines, alrSentence(now, alarm.num, true, res))
+			case "ttm":
+				lines = append(lines, ttmSentence(now, alarm.num, res))
+			}
+		}
+	}
+	for mmsi, alarm := range m.alarms {
+		if active[mmsi] {
+			continue
+		}
+		slog.Info("CPA alarm cleared", "mmsi", mmsi)
+		if alarm.num > 0 && m.emit == "alr" {
+			lines = append(lines, alrSentence(now, alarm.num, false, &cpaResult{MMSI: mmsi}))
+		}
+		delete(m.alarms, mmsi)
+	}
+	aisCPAAlarms.Set(float64(len(m.alarms)))
+
+	slices.SortFunc(results, func(a, b cpaResult) bool {
+		if (a.TCPA < 0) != (b.TCPA < 0) {
+			return a.TCPA >= 0
+		}
+		if a.TCPA < 0 {
+			return a.Range < b.Range
+		}
+		return a.TCPA < b.TCPA
+	})
+	m.results = results
+	return lines
+}
+
+// targetNumber returns the lowest target number not used by a current
+// alarm, or zero if they are all taken.
+func (m *cpaMonitor) targetNumber() int {
+	used := make(map[int]bool, len(m.alarms))
+	for _, alarm := range m.alarms {
+		used[alarm.num] = true
+	}
+	for i := 1; i <= cpaMaxTargetNums; i++ {
+		if !used[i] {
+			return i
+		}
+	}
+	return 0
+}
+
+// ServeJSON serves our own position and the CPA of all targets, ordered
+// by time to CPA and with those already passed last.
+func (m *cpaMonitor) ServeJSON(w http.ResponseWriter, r *http.Request) {
+	m.mut.Lock()
+	res := struct {
+		OwnShip *ownShipFix `json:"own_ship"`
+		Targets []cpaResult `json:"targets"`
+	}{m.fix, append([]cpaResult{}, m.results...)}
+	m.mut.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// ttmSentence formats a tracked target message for the target.
+func ttmSentence(now time.Time, num int, res *cpaResult) string {
+	name := res.Name
+	if name == "" {
+		name = strconv.FormatUint(uint64(res.MMSI), 10)
+	}
+	return formatSentence("$"+cpaTalker+nmea.TypeTTM,
+		fmt.Sprintf("%02d", num),
+		fmt.Sprintf("%.2f", res.Range),
+		fmt.Sprintf("%.1f", res.Bearing), "T",
+		fmt.Sprintf("%.1f", res.SOG),
+		fmt.Sprintf("%.1f", res.COG), "T",
+		fmt.Sprintf("%.2f", res.CPA),
+		fmt.Sprintf("%.1f", res.TCPA), "N",
+		name, "T", "",
+		now.UTC().Format("150405.00"), "A")
+}
+
+// alrSentence formats an alarm sentence for the target, either active or
+// cleared.
+func alrSentence(now time.Time, num int, active bool, res *cpaResult) string {
+	cond := "V"
+	text := fmt.Sprintf("CPA CLEARED %d", res.MMSI)
+	if active {
+		cond = "A"
+		text = fmt.Sprintf("CPA %.2fNM %.1fMIN %d %s", res.CPA, res.TCPA, res.MMSI, res.Name)
+	}
+	return formatSentence("$"+cpaTalker+nmea.TypeALR,
+		now.UTC().Format("150405.00"),
+		fmt.Sprintf("%03d", num),
+		cond, "V",
+		strings.TrimSpace(text))
+}
+
+// formatSentence joins the address and fields into a sentence with a
+// checksum. Fields are cleaned of characters reserved by NMEA 0183.
+func formatSentence(address string, fields ...string) string {
+	var sb strings.Builder
+	sb.WriteString(address)
+	for _, f := range fields {
+		sb.WriteByte(',')
+		sb.WriteString(strings.Map(func(r rune) rune {
+			switch r {
+			case ',', '*', '$', '!', '\\', '^', '~':
+				return ' '
+			}
+			if r < 0x20 || r > 0x7e {
+				return ' '
+			}
+			return r
+		}, f))
+	}
+	return sb.String() + "*" + nmea.Checksum(sb.String()[1:])
+}
+
+func round(v float64, decimals int) float64 {
+	p := math.Pow(10, float64(decimals))
+	return math.Round(v*p) / p
+}
@@ -0,0 +1,70 @@
+package serve
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCPAMonitor(t *testing.T) {
+	now := time.Now()
+	sog, cog := 10.0, 180.0
+	targets := newAISTargets(nil, time.Hour)
+	targets.targets[123456789] = &aisTarget{
+		MMSI:     123456789,
+		Class:    "A",
+		Name:     "CLOSING, IN",
+		LastSeen: now,
+		Position: &aisPosition{Lat: 57.1, Lon: 11, SOG: &sog, COG: &cog, Time: now},
+	}
+	targets.targets[234567890] = &aisTarget{
+		MMSI:     234567890,
+		Class:    "B",
+		LastSeen: now,
+		Position: &aisPosition{Lat: 56.9, Lon: 11, SOG: &sog, COG: &cog, Time: now},
+	}
+	ownSOG, ownCOG := 5.0, 0.0
+	targets.targets[345678901] = &aisTarget{
+		MMSI:     345678901, // our own transponder, heard as VDM
+		Class:    "B",
+		LastSeen: now,
+		Position: &aisPosition{Lat: 57, Lon: 11, SOG: &ownSOG, COG: &ownCOG, Time: now},
+	}
+
+	own := newOwnShip(nil, positionSources, 10*time.Second, 345678901)
+	own.update(ownShipFix{Lat: 57, Lon: 11, SOG: 5, COG: 0, Time: now, Source: "rmc"})
+
+	m := newCPAMonitor(targets, own, 0.5, 30*time.Minute, "alr", nil)
+	lines := m.evaluate(now)
+	if len(m.results) != 2 {
+		t.Fatalf("expected two results, got %d", len(m.results))
+	}
+	if res := m.results[0]; res.MMSI != 123456789 || !res.Alarm || res.CPA > 0.01 || res.TCPA < 23.9 || res.TCPA > 24.1 {
+		t.Errorf("unexpected result for closing target: %+v", res)
+	}
+	if res := m.results[1]; res.MMSI != 234567890 || res.Alarm {
+		t.Errorf("unexpected result for diverging target: %+v", res)
+	}
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], "$VRALR,") || !strings.Contains(lines[0], ",001,A,V,") || !checksumOK(lines[0]) {
+		t.Errorf("unexpected alarm sentences: %q", lines)
+	}
+
+	// The target turns away and the alarm is cleared.
+	cog = 90
+	lines = m.evaluate(now.Add(time.Second))
+	if len(m.alarms) != 0 {
+		t.Error("alarm should be cleared")
+	}
+	if len(lines) != 1 || !strings.Contains(lines[0], ",001,V,V,") || !checksumOK(lines[0]) {
+		t.Errorf("unexpected cleared sentences: %q", lines)
+	}
+}
+
+func TestTTMSentence(t *testing.T) {
+	res := &cpaResult{MMSI: 123456789, Name: "TEST*SHIP", Range: 1.5, Bearing: 45, SOG: 12.3, COG: 270, CPA: 0.2, TCPA: 7.5}
+	line := ttmSentence(time.Date(2023, 6, 1, 12, 34, 56, 0, time.UTC), 3, res)
+	want := "$VRTTM,03,1.50,45.0,T,12.3,270.0,T,0.20,7.5,N,TEST SHIP,T,,123456.00,A*"
+	if !strings.HasPrefix(line, want) || !checksumOK(line) {
+		t.Errorf("got %q, want %q", line, want)
+	}
+}
@@ -0,0 +1,127 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"calmh.dev/nmea-collect/internal/aisregistry"
+	"calmh.dev/nmea-collect/internal/geometry"
+	"github.com/BertoldVdb/go-ais"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/exp/slog"
+)
+
+var (
+	aisRegistryVessels = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nmea",
+		Subsystem: "ais",
+		Name:      "registry_vessels",
+	})
+	aisRegistrySaveErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "nmea",
+		Subsystem: "ais",
+		Name:      "registry_save_errors_total",
+	})
+)
+
+// aisRegistryRecorder feeds received AIS messages into the persistent
+// vessel registry and saves it periodically.
+type aisRegistryRecorder struct {
+	c            <-chan *Message
+	own          *ownShip
+	reg          *aisregistry.Registry
+	saveInterval time.Duration
+}
+
+func recordAISRegistry(c <-chan *Message, own *ownShip, reg *aisregistry.Registry, saveInterval time.Duration) *aisRegistryRecorder {
+	return &aisRegistryRecorder{
+		c:            c,
+		own:          own,
+		reg:          reg,
+		saveInterval: saveInterval,
+	}
+}
+
+func (r *aisRegistryRecorder) String() string {
+	return fmt.Sprintf("ais-registry-recorder@%p", r)
+}
+
+func (r *aisRegistryRecorder) Serve(ctx context.Context) error {
+	defer r.save()
+
+	saveTicker := time.NewTicker(r.saveInterval)
+	defer saveTicker.Stop()
+
+	for {
+		select {
+		case msg := <-r.c:
+			if msg.OwnVessel() {
+				continue
+			}
+			if pkt := msg.AIS(); pkt != nil {
+				r.record(pkt, msg.Time(), msg.Received)
+			}
+
+		case <-saveTicker.C:
+			r.save()
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// record records the packet in the registry with the time stamp, while
+// the receive time decides whether our own position is current.
+func (r *aisRegistryRecorder) record(pkt ais.Packet, when, received time.Time) {
+	mmsi := pkt.GetHeader().UserID
+
+	switch p := pkt.(type) {
+	case ais.PositionReport:
+		r.reg.Seen(mmsi, "A", when)
+	case ais.StandardClassBPositionReport:
+		r.reg.Seen(mmsi, "B", when)
+	case ais.ExtendedClassBPositionReport:
+		r.reg.Seen(mmsi, "B", when)
+		r.reg.SetName(mmsi, aisString(p.Name), when)
+	case ais.ShipStaticData:
+		r.reg.Seen(mmsi, "A", when)
+		r.reg.SetName(mmsi, aisString(p.Name), when)
+		r.reg.SetCallSign(mmsi, aisString(p.CallSign), when)
+	case ais.StaticDataReport:
+		r.reg.Seen(mmsi, "B", when)
+		if !p.PartNumber {
+			r.reg.SetName(mmsi, aisString(p.ReportA.Name), when)
+		} else {
+			r.reg.SetCallSign(mmsi, aisString(p.ReportB.CallSign), when)
+		}
+	case ais.BaseStationReport:
+		r.reg.Seen(mmsi, "base", when)
+	case ais.AidsToNavigationReport:
+		r.reg.Seen(mmsi, "aton", when)
+		r.reg.SetName(mmsi, aisString(p.Name+p.NameExtension), when)
+	case ais.StandardSearchAndRescueAircraftReport:
+		r.reg.Seen(mmsi, "sar", when)
+	default:
+		r.reg.Seen(mmsi, "", when)
+	}
+
+	if lat, lon, ok := aisPacketPosition(pkt); ok {
+		if fix, ok := r.own.Fix(received); ok {
+			rng := geometry.Distance(fix.Lat, fix.Lon, lat, lon)
+			if rng <= coverageMaxRange {
+				r.reg.ObserveRange(mmsi, rng, when)
+			}
+		}
+	}
+}
+
+func (r *aisRegistryRecorder) save() {
+	if err := r.reg.Save(); err != nil {
+		slog.Error("Saving AIS registry", "error", err)
+		aisRegistrySaveErrors.Inc()
+	}
+	aisRegistryVessels.Set(float64(r.reg.Len()))
+}
@@ -0,0 +1,50 @@
+package serve
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"calmh.dev/nmea-collect/internal/aisregistry"
+)
+
+func TestAISRegistryRecorderTagBlockTime(t *testing.T) {
+	reg, err := aisregistry.Open(filepath.Join(t.TempDir(), "registry.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	own := newOwnShip(nil, positionSources, 10*time.Second, 0)
+	r := recordAISRegistry(nil, own, reg, time.Hour)
+
+	// A message from a delayed feed: the tag block time is just after our
+	// last fix, but we received it five minutes later, by which time the
+	// fix is stale.
+	stamp := time.Unix(1577836800, 0)
+	msg := acceptLine("test", `\c:1577836800*58\!AIVDM,1,1,,A,18;Or00w1mPrD:dO`+"`"+`=bD@3LN08;b,0*2E`)
+	msg.Received = stamp.Add(5 * time.Minute)
+	lat, lon, ok := aisPacketPosition(msg.AIS())
+	if !ok {
+		t.Fatal("should have a position")
+	}
+	own.update(ownShipFix{Lat: lat + 0.1, Lon: lon, Time: stamp.Add(-10 * time.Second), Source: "rmc"})
+
+	r.record(msg.AIS(), msg.Time(), msg.Received)
+	v, ok := reg.Vessel(msg.AIS().GetHeader().UserID)
+	if !ok {
+		t.Fatal("vessel should be recorded")
+	}
+	if !v.FirstSeen.Equal(stamp) || !v.LastSeen.Equal(stamp) {
+		t.Errorf("seen times should be from the tag block, got %v and %v", v.FirstSeen, v.LastSeen)
+	}
+	if v.ClosestNM != nil {
+		t.Errorf("range should not be recorded against a stale position, got %v", *v.ClosestNM)
+	}
+
+	// With a current position, the range is recorded at the tag block time.
+	own.update(ownShipFix{Lat: lat + 0.1, Lon: lon, Time: msg.Received, Source: "rmc"})
+	r.record(msg.AIS(), msg.Time(), msg.Received)
+	v, _ = reg.Vessel(msg.AIS().GetHeader().UserID)
+	if v.ClosestNM == nil || *v.ClosestNM < 5.9 || *v.ClosestNM > 6.1 || !v.ClosestTime.Equal(stamp) {
+		t.Errorf("range should be recorded against the current position, got %v at %v", v.ClosestNM, v.ClosestTime)
+	}
+}
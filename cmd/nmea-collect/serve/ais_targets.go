@@ -0,0 +1,394 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BertoldVdb/go-ais"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/exp/slices"
+)
+
+var (
+	aisTargetsByShipType = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nmea",
+		Subsystem: "ais",
+		Name:      "targets_by_ship_type",
+	}, []string{"ship_type"})
+	aisTargetsByNavStatus = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nmea",
+		Subsystem: "ais",
+		Name:      "targets_by_nav_status",
+	}, []string{"nav_status"})
+)
+
+// aisTarget is what we know about a vessel or station, from position
+// reports and static data.
+type aisTarget struct {
+	MMSI        uint32       `json:"mmsi"`
+	Class       string       `json:"class"`
+	LastSeen    time.Time    `json:"last_seen"`
+	Position    *aisPosition `json:"position,omitempty"`
+	NavStatus   string       `json:"nav_status,omitempty"`
+	Name        string       `json:"name,omitempty"`
+	CallSign    string       `json:"call_sign,omitempty"`
+	IMO         uint32       `json:"imo,omitempty"`
+	ShipType    string       `json:"ship_type,omitempty"`
+	ShipTypeID  uint8        `json:"ship_type_id,omitempty"`
+	Length      int          `json:"length_m,omitempty"`
+	Beam        int          `json:"beam_m,omitempty"`
+	Draught     float64      `json:"draught_m,omitempty"`
+	Destination string       `json:"destination,omitempty"`
+	ETA         string       `json:"eta,omitempty"`
+}
+
+type aisPosition struct {
+	Lat     float64   `json:"lat"`
+	Lon     float64   `json:"lon"`
+	SOG     *float64  `json:"sog,omitempty"`
+	COG     *float64  `json:"cog,omitempty"`
+	Heading *int      `json:"heading,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// aisTargets keeps the live target table, fed by decoded AIS packets.
+type aisTargets struct {
+	c         <-chan *Message
+	retention time.Duration
+
+	mut     sync.Mutex
+	targets map[uint32]*aisTarget
+}
+
+func newAISTargets(c <-chan *Message, retention time.Duration) *aisTargets {
+	return &aisTargets{
+		c:         c,
+		retention: retention,
+		targets:   make(map[uint32]*aisTarget),
+	}
+}
+
+func (t *aisTargets) String() string {
+	return fmt.Sprintf("ais-targets@%p", t)
+}
+
+func (t *aisTargets) Serve(ctx context.Context) error {
+	accountTicker := time.NewTicker(30 * time.Second)
+	defer accountTicker.Stop()
+
+	for {
+		select {
+		case msg := <-t.c:
+			if msg.OwnVessel() {
+				continue
+			}
+			if pkt := msg.AIS(); pkt != nil {
+				t.update(pkt, msg.Received)
+			}
+
+		case <-accountTicker.C:
+			t.account(time.Now())
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (t *aisTargets) update(pkt ais.Packet, when time.Time) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	hdr := pkt.GetHeader()
+	tgt, ok := t.targets[hdr.UserID]
+	if !ok {
+		tgt = &aisTarget{MMSI: hdr.UserID}
+	}
+
+	switch p := pkt.(type) {
+	case ais.PositionReport:
+		tgt.Class = "A"
+		tgt.setPosition(newAISPosition(float64(p.Latitude), float64(p.Longitude), float64(p.Sog), float64(p.Cog), int(p.TrueHeading), when))
+		tgt.NavStatus = aisNavStatus(p.NavigationalStatus)
+
+	case ais.StandardClassBPositionReport:
+		tgt.Class = "B"
+		tgt.setPosition(newAISPosition(float64(p.Latitude), float64(p.Longitude), float64(p.Sog), float64(p.Cog), int(p.TrueHeading), when))
+
+	case ais.ExtendedClassBPositionReport:
+		tgt.Class = "B"
+		tgt.setPosition(newAISPosition(float64(p.Latitude), float64(p.Longitude), float64(p.Sog), float64(p.Cog), int(p.TrueHeading), when))
+		tgt.Name = aisString(p.Name)
+		tgt.setShipType(p.Type)
+		tgt.setDimension(p.Dimension)
+
+	case ais.ShipStaticData:
+		tgt.Class = "A"
+		tgt.Name = aisString(p.Name)
+		tgt.CallSign = aisString(p.CallSign)
+		tgt.IMO = p.ImoNumber
+		tgt.setShipType(p.Type)
+		tgt.setDimension(p.Dimension)
+		tgt.Draught = float64(p.MaximumStaticDraught)
+		tgt.Destination = aisString(p.Destination)
+		tgt.ETA = aisETA(p.Eta)
+
+	case ais.StaticDataReport:
+		if tgt.Class == "" {
+			tgt.Class = "B"
+		}
+		if !p.PartNumber {
+			tgt.Name = aisString(p.ReportA.Name)
+		} else {
+			tgt.CallSign = aisString(p.ReportB.CallSign)
+			tgt.setShipType(p.ReportB.ShipType)
+			tgt.setDimension(p.ReportB.Dimension)
+		}
+
+	case ais.BaseStationReport:
+		tgt.Class = "base"
+		tgt.setPosition(newAISPosition(float64(p.Latitude), float64(p.Longitude), -1, -1, -1, when))
+
+	case ais.AidsToNavigationReport:
+		tgt.Class = "aton"
+		tgt.Name = aisString(p.Name + p.NameExtension)
+		tgt.setPosition(newAISPosition(float64(p.Latitude), float64(p.Longitude), -1, -1, -1, when))
+
+	case ais.StandardSearchAndRescueAircraftReport:
+		tgt.Class = "sar"
+		tgt.setPosition(newAISPosition(float64(p.Latitude), float64(p.Longitude), float64(p.Sog), float64(p.Cog), -1, when))
+
+	default:
+		if !ok {
+			// Don't create targets from other message types, as the
+			// user ID isn't necessarily a vessel.
+			return
+		}
+	}
+
+	tgt.LastSeen = when
+	t.targets[hdr.UserID] = tgt
+}
+
+// account expires old targets and updates the metrics.
+func (t *aisTargets) account(now time.Time) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	shipTypes := make(map[string]int)
+	navStatuses := make(map[string]int)
+	for mmsi, tgt := range t.targets {
+		if now.Sub(tgt.LastSeen) > t.retention {
+			delete(t.targets, mmsi)
+			continue
+		}
+		if tgt.Class != "A" && tgt.Class != "B" {
+			continue
+		}
+		shipTypes[aisShipTypeCategory(tgt.ShipTypeID)]++
+		if tgt.NavStatus != "" {
+			navStatuses[tgt.NavStatus]++
+		}
+	}
+
+	aisTargetsByShipType.Reset()
+	for k, v := range shipTypes {
+		aisTargetsByShipType.WithLabelValues(k).Set(float64(v))
+	}
+	aisTargetsByNavStatus.Reset()
+	for k, v := range navStatuses {
+		aisTargetsByNavStatus.WithLabelValues(k).Set(float64(v))
+	}
+}
+
+// Snapshot returns a copy of the current targets, ordered by MMSI.
+func (t *aisTargets) Snapshot() []aisTarget {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	res := make([]aisTarget, 0, len(t.targets))
+	for _, tgt := range t.targets {
+		res = append(res, *tgt)
+	}
+	slices.SortFunc(res, func(a, b aisTarget) bool {
+		return a.MMSI < b.MMSI
+	})
+	return res
+}
+
+// Target returns a copy of the given target, if known.
+func (t *aisTargets) Target(mmsi uint32) (aisTarget, bool) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	tgt, ok := t.targets[mmsi]
+	if !ok {
+		return aisTarget{}, false
+	}
+	return *tgt, true
+}
+
+// ServeJSON serves the target table as a JSON array.
+func (t *aisTargets) ServeJSON(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(t.Snapshot())
+}
+
+// ServeGeoJSON serves the targets with a known position as a GeoJSON
+// feature collection.
+func (t *aisTargets) ServeGeoJSON(w http.ResponseWriter, r *http.Request) {
+	fc := geoJSONFeatureCollection{Type: "FeatureCollection", Features: []geoJSONFeature{}}
+	for _, tgt := range t.Snapshot() {
+		if tgt.Position == nil {
+			continue
+		}
+		fc.Features = append(fc.Features, geoJSONFeature{
+			Type:       "Feature",
+			ID:         tgt.MMSI,
+			Geometry:   geoJSONGeometry{Type: "Point", Coordinates: []float64{tgt.Position.Lon, tgt.Position.Lat}},
+			Properties: tgt,
+		})
+	}
+	w.Header().Set("Content-Type", "application/geo+json")
+	_ = json.NewEncoder(w).Encode(fc)
+}
+
+type geoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+type geoJSONFeature struct {
+	Type       string          `json:"type"`
+	ID         any             `json:"id,omitempty"`
+	Geometry   geoJSONGeometry `json:"geometry"`
+	Properties any             `json:"properties"`
+}
+
+type geoJSONGeometry struct {
+	Type        string `json:"type"`
+	Coordinates any    `json:"coordinates"`
+}
+
+// setPosition updates the position, unless the new one isn't available.
+func (tgt *aisTarget) setPosition(pos *aisPosition) {
+	if pos != nil {
+		tgt.Position = pos
+	}
+}
+
+func (tgt *aisTarget) setShipType(typ uint8) {
+	tgt.ShipTypeID = typ
+	tgt.ShipType = aisShipTypeCategory(typ)
+}
+
+func (tgt *aisTarget) setDimension(d ais.FieldDimension) {
+	tgt.Length = int(d.A) + int(d.B)
+	tgt.Beam = int(d.C) + int(d.D)
+}
+
+// newAISPosition returns the position, or nil if it's not available.
+// Negative or out of range speed, course and heading are taken as not
+// available.
+func newAISPosition(lat, lon, sog, cog float64, heading int, when time.Time) *aisPosition {
+	if lat > 90 || lat < -90 || lon > 180 || lon < -180 {
+		return nil
+	}
+	pos := &aisPosition{Lat: lat, Lon: lon, Time: when}
+	if sog >= 0 && sog < 102.3 {
+		pos.SOG = &sog
+	}
+	if cog >= 0 && cog < 360 {
+		pos.COG = &cog
+	}
+	if heading >= 0 && heading < 360 {
+		pos.Heading = &heading
+	}
+	return pos
+}
+
+func aisString(s string) string {
+	return strings.TrimSpace(strings.TrimRight(s, "@"))
+}
+
+func aisETA(eta ais.FieldETA) string {
+	if eta.Month == 0 || eta.Day == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%02d-%02dT%02d:%02d", eta.Month, eta.Day, eta.Hour, eta.Minute)
+}
+
+// aisShipTypeCategory returns the category name for the ITU-R M.1371
+// ship type code.
+func aisShipTypeCategory(typ uint8) string {
+	switch {
+	case typ >= 20 && typ <= 29:
+		return "wing_in_ground"
+	case typ == 30:
+		return "fishing"
+	case typ == 31 || typ == 32:
+		return "towing"
+	case typ == 33:
+		return "dredging"
+	case typ == 34:
+		return "diving"
+	case typ == 35:
+		return "military"
+	case typ == 36:
+		return "sailing"
+	case typ == 37:
+		return "pleasure_craft"
+	case typ >= 40 && typ <= 49:
+		return "high_speed_craft"
+	case typ == 50:
+		return "pilot"
+	case typ == 51:
+		return "search_and_rescue"
+	case typ == 52:
+		return "tug"
+	case typ == 53:
+		return "port_tender"
+	case typ == 54:
+		return "anti_pollution"
+	case typ == 55:
+		return "law_enforcement"
+	case typ == 58:
+		return "medical"
+	case typ >= 60 && typ <= 69:
+		return "passenger"
+	case typ >= 70 && typ <= 79:
+		return "cargo"
+	case typ >= 80 && typ <= 89:
+		return "tanker"
+	case typ >= 90 && typ <= 99:
+		return "other"
+	default:
+		return "unknown"
+	}
+}
+
+var aisNavStatuses = []string{
+	0:  "under_way_using_engine",
+	1:  "at_anchor",
+	2:  "not_under_command",
+	3:  "restricted_manoeuvrability",
+	4:  "constrained_by_draught",
+	5:  "moored",
+	6:  "aground",
+	7:  "engaged_in_fishing",
+	8:  "under_way_sailing",
+	14: "ais_sart",
+	15: "undefined",
+}
+
+func aisNavStatus(status uint8) string {
+	if int(status) < len(aisNavStatuses) && aisNavStatuses[status] != "" {
+		return aisNavStatuses[status]
+	}
+	return "reserved"
+}
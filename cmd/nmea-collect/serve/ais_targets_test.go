@@ -0,0 +1,42 @@
+package serve
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAISTargets(t *testing.T) {
+	a := assembleAIS(nil, nil, time.Minute)
+	a.pending = make(map[aisFragmentKey]*aisFragments)
+	targets := newAISTargets(nil, time.Hour)
+
+	for _, line := range readTestLines(t, "testdata/raw2") {
+		msg := acceptLine("test", line)
+		a.process(msg)
+		if pkt := msg.AIS(); pkt != nil {
+			targets.update(pkt, msg.Received)
+		}
+	}
+
+	snap := targets.Snapshot()
+	if len(snap) == 0 {
+		t.Fatal("no targets")
+	}
+	var named, positioned int
+	for _, tgt := range snap {
+		if tgt.Name != "" {
+			named++
+		}
+		if tgt.Position != nil {
+			positioned++
+		}
+	}
+	if named == 0 || positioned == 0 {
+		t.Errorf("expected named and positioned targets, got %d and %d of %d", named, positioned, len(snap))
+	}
+
+	targets.account(time.Now().Add(2 * time.Hour))
+	if len(targets.Snapshot()) != 0 {
+		t.Error("targets should expire")
+	}
+}
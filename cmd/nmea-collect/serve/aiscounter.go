@@ -3,26 +3,74 @@ package serve
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/BertoldVdb/go-ais"
 	nmea "github.com/adrianmo/go-nmea"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/exp/slices"
 )
 
-const contactRetention = 5 * time.Minute
+var (
+	aisContacts = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nmea",
+		Subsystem: "ais",
+		Name:      "contacts",
+	}, []string{"class", "window"})
+	// aisContactsLegacy is the contact count from before there were
+	// windows and class B was split, counting classes A and B over five
+	// minutes. Deprecated in favour of aisContacts; to be removed in the
+	// next release.
+	aisContactsLegacy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nmea",
+		Subsystem: "ais",
+		Name:      "contacts_5min",
+	}, []string{"class"})
+	aisMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nmea",
+		Subsystem: "ais",
+		Name:      "messages_total",
+	}, []string{"type", "channel", "source"})
+)
+
+// aisContactClasses are the kinds of stations we count distinct contacts
+// for. Class B units are split by whether they are carrier sense (CS) or
+// self organising (SO) TDMA units.
+var aisContactClasses = []string{"A", "B-CS", "B-SO", "base_station", "aton", "sar"}
+
+// aisLegacyContactWindow and aisLegacyContactClasses are the window and
+// classes of aisContactsLegacy.
+const aisLegacyContactWindow = 5 * time.Minute
 
-var aisContacts = promauto.NewGaugeVec(prometheus.GaugeOpts{
-	Namespace: "nmea",
-	Subsystem: "ais",
-	Name:      "contacts_5min",
-}, []string{"class"})
+var aisLegacyContactClasses = map[string]string{"A": "A", "B-CS": "B", "B-SO": "B"}
 
 type aisContactsCounter struct {
-	c         <-chan string
-	contactsA map[int32]time.Time
-	contactsB map[int32]time.Time
+	c         <-chan *Message
+	windows   []time.Duration
+	retention time.Duration                   // the longest window, or the legacy one
+	contacts  map[string]map[uint32]time.Time // class -> MMSI -> last seen
+}
+
+func newAISContactsCounter(c <-chan *Message, windows []time.Duration) *aisContactsCounter {
+	windows = slices.Clone(windows)
+	slices.Sort(windows)
+	contacts := make(map[string]map[uint32]time.Time)
+	for _, class := range aisContactClasses {
+		contacts[class] = make(map[uint32]time.Time)
+	}
+	retention := aisLegacyContactWindow
+	if len(windows) > 0 && windows[len(windows)-1] > retention {
+		retention = windows[len(windows)-1]
+	}
+	return &aisContactsCounter{
+		c:         c,
+		windows:   windows,
+		retention: retention,
+		contacts:  contacts,
+	}
 }
 
 func (l *aisContactsCounter) String() string {
@@ -30,49 +78,30 @@ func (l *aisContactsCounter) String() string {
 }
 
 func (l *aisContactsCounter) Serve(ctx context.Context) error {
-	if l.contactsA == nil {
-		l.contactsA = make(map[int32]time.Time)
-	}
-	if l.contactsB == nil {
-		l.contactsB = make(map[int32]time.Time)
-	}
-
+	l.account(time.Now())
 	accountTicker := time.NewTicker(time.Minute)
 	defer accountTicker.Stop()
 
-	dec := ais.CodecNew(false, false)
 	for {
 		select {
-		case line := <-l.c:
-			sentence, err := nmea.Parse(line)
-			if err != nil {
+		case msg := <-l.c:
+			pkt := msg.AIS()
+			if pkt == nil {
 				continue
 			}
 
-			vdmvdo, ok := sentence.(nmea.VDMVDO)
-			if !ok {
-				continue
-			}
-			if vdmvdo.NumFragments > 1 {
+			hdr := pkt.GetHeader()
+			aisMessages.WithLabelValues(strconv.Itoa(int(hdr.MessageID)), aisChannel(msg), msg.Source).Inc()
+			if msg.OwnVessel() {
 				continue
 			}
 
-			pkt := dec.DecodePacket(vdmvdo.Payload)
-			if pkt == nil {
-				continue
+			if class := aisContactClass(pkt); class != "" {
+				l.contacts[class][hdr.UserID] = msg.Received
 			}
 
-			hdr := pkt.GetHeader()
-			switch hdr.MessageID {
-			case 1, 2, 3: // Class A position report
-				l.contactsA[int32(hdr.UserID)] = time.Now()
-			case 18: // Class B position report
-				l.contactsB[int32(hdr.UserID)] = time.Now()
-			}
-			l.account()
-
 		case <-accountTicker.C:
-			l.account()
+			l.account(time.Now())
 
 		case <-ctx.Done():
 			return ctx.Err()
@@ -80,17 +109,91 @@ func (l *aisContactsCounter) Serve(ctx context.Context) error {
 	}
 }
 
-func (l *aisContactsCounter) account() {
-	for k, v := range l.contactsA {
-		if time.Since(v) > contactRetention {
-			delete(l.contactsA, k)
+// account expires contacts older than the longest window and updates
+// the metrics for each window.
+func (l *aisContactsCounter) account(now time.Time) {
+	legacy := map[string]int{"A": 0, "B": 0}
+	for class, contacts := range l.contacts {
+		counts := make([]int, len(l.windows))
+		for mmsi, seen := range contacts {
+			age := now.Sub(seen)
+			if age > l.retention {
+				delete(contacts, mmsi)
+				continue
+			}
+			for i, w := range l.windows {
+				if age <= w {
+					counts[i]++
+				}
+			}
+			if legacyClass, ok := aisLegacyContactClasses[class]; ok && age <= aisLegacyContactWindow {
+				legacy[legacyClass]++
+			}
 		}
+		for i, w := range l.windows {
+			aisContacts.WithLabelValues(class, formatWindow(w)).Set(float64(counts[i]))
+		}
+	}
+	for class, count := range legacy {
+		aisContactsLegacy.WithLabelValues(class).Set(float64(count))
 	}
-	aisContacts.WithLabelValues("A").Set(float64(len(l.contactsA)))
-	for k, v := range l.contactsB {
-		if time.Since(v) > contactRetention {
-			delete(l.contactsB, k)
+}
+
+// aisContactClass returns the kind of station sending the packet, or an
+// empty string for packets that don't tell.
+func aisContactClass(pkt ais.Packet) string {
+	switch p := pkt.(type) {
+	case ais.PositionReport:
+		return "A"
+	case ais.StandardClassBPositionReport:
+		if p.ClassBUnit {
+			return "B-CS"
 		}
+		return "B-SO"
+	case ais.ExtendedClassBPositionReport:
+		// Has no unit flag; counted with the carrier sense units.
+		return "B-CS"
+	case ais.BaseStationReport:
+		return "base_station"
+	case ais.AidsToNavigationReport:
+		return "aton"
+	case ais.StandardSearchAndRescueAircraftReport:
+		return "sar"
+	default:
+		return ""
+	}
+}
+
+// aisChannel returns the radio channel, A or B, the message was received
+// on.
+func aisChannel(msg *Message) string {
+	sent, err := msg.Sentence()
+	if err != nil {
+		return "unknown"
+	}
+	vdmvdo, ok := sent.(nmea.VDMVDO)
+	if !ok {
+		return "unknown"
+	}
+	switch vdmvdo.Channel {
+	case "A", "1":
+		return "A"
+	case "B", "2":
+		return "B"
+	default:
+		return "unknown"
+	}
+}
+
+// formatWindow returns the duration without trailing zero units, i.e.
+// "5m" rather than "5m0s".
+func formatWindow(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
 	}
-	aisContacts.WithLabelValues("B").Set(float64(len(l.contactsB)))
+	return s
 }
@@ -0,0 +1,73 @@
+package serve
+
+import (
+	"testing"
+	"time"
+
+	"github.com/BertoldVdb/go-ais"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFormatWindow(t *testing.T) {
+	cases := map[time.Duration]string{
+		5 * time.Minute:  "5m",
+		time.Hour:        "1h",
+		24 * time.Hour:   "24h",
+		90 * time.Minute: "1h30m",
+		30 * time.Second: "30s",
+	}
+	for d, want := range cases {
+		if got := formatWindow(d); got != want {
+			t.Errorf("formatWindow(%v) = %q, want %q", d, got, want)
+		}
+	}
+}
+
+func TestAISContactsCounterWindows(t *testing.T) {
+	now := time.Now()
+	l := newAISContactsCounter(nil, []time.Duration{time.Hour, 5 * time.Minute})
+	l.contacts["A"][1] = now.Add(-time.Minute)
+	l.contacts["A"][2] = now.Add(-30 * time.Minute)
+	l.contacts["A"][3] = now.Add(-2 * time.Hour)
+	l.account(now)
+
+	if v := testutil.ToFloat64(aisContacts.WithLabelValues("A", "5m")); v != 1 {
+		t.Errorf("5m window: %v, want 1", v)
+	}
+	if v := testutil.ToFloat64(aisContacts.WithLabelValues("A", "1h")); v != 2 {
+		t.Errorf("1h window: %v, want 2", v)
+	}
+	if len(l.contacts["A"]) != 2 {
+		t.Error("old contact should be expired")
+	}
+
+	// The deprecated metric counts class B units of both kinds.
+	l.contacts["B-CS"][4] = now
+	l.contacts["B-SO"][5] = now.Add(-2 * time.Minute)
+	l.contacts["B-SO"][6] = now.Add(-10 * time.Minute)
+	l.account(now)
+	if v := testutil.ToFloat64(aisContactsLegacy.WithLabelValues("A")); v != 1 {
+		t.Errorf("legacy A: %v, want 1", v)
+	}
+	if v := testutil.ToFloat64(aisContactsLegacy.WithLabelValues("B")); v != 2 {
+		t.Errorf("legacy B: %v, want 2", v)
+	}
+}
+
+func TestAISContactClass(t *testing.T) {
+	cases := []struct {
+		pkt  ais.Packet
+		want string
+	}{
+		{ais.PositionReport{}, "A"},
+		{ais.StandardClassBPositionReport{ClassBUnit: true}, "B-CS"},
+		{ais.StandardClassBPositionReport{}, "B-SO"},
+		{ais.ExtendedClassBPositionReport{}, "B-CS"},
+		{ais.ShipStaticData{}, ""},
+	}
+	for _, tc := range cases {
+		if got := aisContactClass(tc.pkt); got != tc.want {
+			t.Errorf("%T: got %q, want %q", tc.pkt, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"calmh.dev/nmea-collect/internal/gpx/writer"
+	"github.com/BertoldVdb/go-ais"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/exp/slog"
+)
+
+var (
+	aisTracksActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nmea",
+		Subsystem: "ais",
+		Name:      "tracks_active",
+	})
+	aisTrackFilesCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "nmea",
+		Subsystem: "ais",
+		Name:      "track_files_created_total",
+	})
+)
+
+// aisTrackIdle is how long we keep the track state and name for a vessel
+// we don't hear from, before closing any open file.
+const aisTrackIdle = 15 * time.Minute
+
+// aisTrackCollector records GPX tracks of other vessels, one file per
+// vessel and trip, with the same start and stop logic as our own tracks.
+type aisTrackCollector struct {
+	c       <-chan *Message
+	pattern string          // file pattern, with {mmsi} for the vessel
+	allow   map[uint32]bool // vessels to record, or nil for all
+	newGPX  func(open func(time.Time) (io.WriteCloser, error)) *writer.AutoGPX
+
+	opener   func(mmsi uint32) func(time.Time) (io.WriteCloser, error)
+	tracks   map[uint32]*aisTrack
+	names    map[uint32]aisTrackName
+	logger   *slog.Logger
+	idleTime time.Duration
+}
+
+type aisTrack struct {
+	gpx      *writer.AutoGPX
+	lastSeen time.Time
+}
+
+type aisTrackName struct {
+	name     string
+	lastSeen time.Time
+}
+
+func collectAISTracks(c <-chan *Message, logger *slog.Logger, pattern string, mmsis []uint32, newGPX func(open func(time.Time) (io.WriteCloser, error)) *writer.AutoGPX) *aisTrackCollector {
+	var allow map[uint32]bool
+	if len(mmsis) > 0 {
+		allow = make(map[uint32]bool, len(mmsis))
+		for _, mmsi := range mmsis {
+			allow[mmsi] = true
+		}
+	}
+	t := &aisTrackCollector{
+		c:        c,
+		pattern:  pattern,
+		allow:    allow,
+		newGPX:   newGPX,
+		tracks:   make(map[uint32]*aisTrack),
+		names:    make(map[uint32]aisTrackName),
+		logger:   logger,
+		idleTime: aisTrackIdle,
+	}
+	t.opener = t.fileOpener
+	return t
+}
+
+func (c *aisTrackCollector) String() string {
+	return fmt.Sprintf("ais-track-collector@%p", c)
+}
+
+func (c *aisTrackCollector) Serve(ctx context.Context) error {
+	defer c.flushAll()
+
+	idleTicker := time.NewTicker(time.Minute)
+	defer idleTicker.Stop()
+
+	for {
+		select {
+		case msg := <-c.c:
+			if msg.OwnVessel() {
+				continue
+			}
+			if pkt := msg.AIS(); pkt != nil {
+				c.process(pkt, msg.Time(), msg.Received)
+			}
+
+		case <-idleTicker.C:
+			c.expire(time.Now())
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// process records the position in the packet, if any, with the time
+// stamp, while the receive time decides when the track is idle.
+func (c *aisTrackCollector) process(pkt ais.Packet, stamp, received time.Time) {
+	mmsi := pkt.GetHeader().UserID
+	if c.allow != nil && !c.allow[mmsi] {
+		return
+	}
+
+	var name string
+	switch p := pkt.(type) {
+	case ais.ShipStaticData:
+		name = aisString(p.Name)
+	case ais.ExtendedClassBPositionReport:
+		name = aisString(p.Name)
+	case ais.StaticDataReport:
+		if !p.PartNumber {
+			name = aisString(p.ReportA.Name)
+		}
+	}
+	if name != "" {
+		c.names[mmsi] = aisTrackName{name: name, lastSeen: received}
+		if track, ok := c.tracks[mmsi]; ok {
+			track.gpx.Name = name
+		}
+	}
+
+	switch pkt.(type) {
+	case ais.PositionReport, ais.StandardClassBPositionReport, ais.ExtendedClassBPositionReport:
+	default:
+		return
+	}
+	lat, lon, ok := aisPacketPosition(pkt)
+	if !ok {
+		return
+	}
+
+	track, ok := c.tracks[mmsi]
+	if !ok {
+		track = &aisTrack{gpx: c.newGPX(c.opener(mmsi))}
+		track.gpx.Name = c.names[mmsi].name
+		c.tracks[mmsi] = track
+		aisTracksActive.Set(float64(len(c.tracks)))
+	}
+	track.lastSeen = received
+	track.gpx.Sample(lat, lon, stamp, nil)
+}
+
+// expire closes the tracks, and forgets the names, of vessels we haven't
+// heard from in a while.
+func (c *aisTrackCollector) expire(now time.Time) {
+	for mmsi, track := range c.tracks {
+		if now.Sub(track.lastSeen) > c.idleTime {
+			track.gpx.Flush()
+			delete(c.tracks, mmsi)
+		}
+	}
+	for mmsi, name := range c.names {
+		if now.Sub(name.lastSeen) > c.idleTime {
+			delete(c.names, mmsi)
+		}
+	}
+	aisTracksActive.Set(float64(len(c.tracks)))
+}
+
+func (c *aisTrackCollector) flushAll() {
+	for _, track := range c.tracks {
+		track.gpx.Flush()
+	}
+}
+
+// fileOpener returns an opener creating track files for the vessel.
+func (c *aisTrackCollector) fileOpener(mmsi uint32) func(time.Time) (io.WriteCloser, error) {
+	return func(t time.Time) (io.WriteCloser, error) {
+		name := strings.ReplaceAll(t.UTC().Format(c.pattern), "{mmsi}", strconv.FormatUint(uint64(mmsi), 10))
+		aisTrackFilesCreated.Inc()
+		return createGPXFile(*c.logger, name)
+	}
+}
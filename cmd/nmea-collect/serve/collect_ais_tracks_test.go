@@ -0,0 +1,103 @@
+package serve
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"calmh.dev/nmea-collect/internal/gpx/writer"
+	"github.com/BertoldVdb/go-ais"
+	"golang.org/x/exp/slog"
+)
+
+type nopCloser struct{ *bytes.Buffer }
+
+func (nopCloser) Close() error { return nil }
+
+func TestAISTrackCollector(t *testing.T) {
+	files := make(map[string]*bytes.Buffer)
+	c := collectAISTracks(nil, slog.Default(), "{mmsi}.gpx", []uint32{123456789}, func(open func(time.Time) (io.WriteCloser, error)) *writer.AutoGPX {
+		return &writer.AutoGPX{Opener: open, SampleInterval: time.Second, TriggerDistanceMeters: 25, TriggerTimeWindow: time.Minute, CooldownTimeWindow: 5 * time.Minute}
+	})
+	c.opener = func(mmsi uint32) func(time.Time) (io.WriteCloser, error) {
+		return func(time.Time) (io.WriteCloser, error) {
+			buf := new(bytes.Buffer)
+			files[strconv.FormatUint(uint64(mmsi), 10)] = buf
+			return nopCloser{buf}, nil
+		}
+	}
+
+	t0 := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	c.process(ais.ShipStaticData{Header: ais.Header{MessageID: 5, UserID: 123456789}, Name: "FLYING CLOUD@@@@"}, t0, t0)
+	for i := 0; i < 10; i++ {
+		for _, mmsi := range []uint32{123456789, 234567890} {
+			c.process(ais.PositionReport{Header: ais.Header{MessageID: 1, UserID: mmsi}, Latitude: ais.FieldLatLonFine(57 + float64(i)*0.001), Longitude: 11}, t0.Add(time.Duration(i)*10*time.Second), t0.Add(time.Duration(i)*10*time.Second))
+		}
+	}
+	c.flushAll()
+
+	if len(files) != 1 {
+		t.Fatalf("expected one track file, got %d", len(files))
+	}
+	gpx := files["123456789"].String()
+	if !strings.Contains(gpx, "<metadata><name>FLYING CLOUD</name></metadata>") {
+		t.Errorf("missing vessel name: %s", gpx)
+	}
+	if n := strings.Count(gpx, "<trkpt"); n != 10 {
+		t.Errorf("expected 10 track points, got %d", n)
+	}
+
+	// Idle vessels are forgotten, names and all.
+	c.expire(t0.Add(time.Hour))
+	if len(c.tracks) != 0 || len(c.names) != 0 {
+		t.Errorf("expected no state after expiry, got %d tracks and %d names", len(c.tracks), len(c.names))
+	}
+}
+
+func TestAISTrackCollectorGeoJSON(t *testing.T) {
+	buf := new(bytes.Buffer)
+	c := collectAISTracks(nil, slog.Default(), "{mmsi}.geojson", nil, func(open func(time.Time) (io.WriteCloser, error)) *writer.AutoGPX {
+		return &writer.AutoGPX{Opener: open, Format: writer.GeoJSON, SampleInterval: time.Second, TriggerDistanceMeters: 25, TriggerTimeWindow: time.Minute, CooldownTimeWindow: 5 * time.Minute}
+	})
+	c.opener = func(uint32) func(time.Time) (io.WriteCloser, error) {
+		return func(time.Time) (io.WriteCloser, error) {
+			return nopCloser{buf}, nil
+		}
+	}
+
+	t0 := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	c.process(ais.ShipStaticData{Header: ais.Header{MessageID: 5, UserID: 123456789}, Name: "FLYING CLOUD@@@@"}, t0, t0)
+	for i := 0; i < 10; i++ {
+		when := t0.Add(time.Duration(i) * 10 * time.Second)
+		c.process(ais.PositionReport{Header: ais.Header{MessageID: 1, UserID: 123456789}, Latitude: ais.FieldLatLonFine(57 + float64(i)*0.001), Longitude: 11}, when, when)
+	}
+	c.flushAll()
+
+	var track struct {
+		Type     string
+		Geometry struct {
+			Type        string
+			Coordinates [][]float64
+		}
+		Properties struct {
+			Name       string
+			CoordTimes []time.Time
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &track); err != nil {
+		t.Fatalf("%v: %s", err, buf)
+	}
+	if track.Type != "Feature" || track.Geometry.Type != "LineString" || track.Properties.Name != "FLYING CLOUD" {
+		t.Errorf("unexpected track: %s", buf)
+	}
+	if n := len(track.Geometry.Coordinates); n != 10 || len(track.Properties.CoordTimes) != n {
+		t.Fatalf("expected 10 points and times, got %d and %d", n, len(track.Properties.CoordTimes))
+	}
+	if c := track.Geometry.Coordinates[9]; c[0] != 11 || c[1] < 57.0089 || c[1] > 57.0091 || !track.Properties.CoordTimes[9].Equal(t0.Add(90*time.Second)) {
+		t.Errorf("unexpected last point %v at %v", c, track.Properties.CoordTimes[9])
+	}
+}
@@ -3,11 +3,9 @@ package serve
 import (
 	"context"
 	"fmt"
-	"strings"
 	"time"
 
 	"calmh.dev/nmea-collect/internal/gpx/writer"
-	nmea "github.com/adrianmo/go-nmea"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -23,6 +21,9 @@ var (
 		Subsystem: "gpx",
 		Name:      "record_positions_total",
 	})
+
+	// The input to the GPX track is the own position tracking, which
+	// counts these.
 	gpxInputMessages = promauto.NewCounter(prometheus.CounterOpts{
 		Namespace: "nmea",
 		Subsystem: "gpx",
@@ -40,13 +41,16 @@ var (
 	})
 )
 
+// gpxCollector records our own track, from whichever position source is
+// currently active. Fixes are dropped, not queued, if writing falls
+// behind; see ownShip.Output.
 type gpxCollector struct {
-	c <-chan string
+	c <-chan ownShipFix
 	w *writer.AutoGPX
 	i *instrumentsCollector
 }
 
-func collectGPX(c <-chan string, w *writer.AutoGPX, i *instrumentsCollector) *gpxCollector {
+func collectGPX(c <-chan ownShipFix, w *writer.AutoGPX, i *instrumentsCollector) *gpxCollector {
 	return &gpxCollector{
 		c: c,
 		w: w,
@@ -61,39 +65,20 @@ func (c *gpxCollector) String() string {
 func (c *gpxCollector) Serve(ctx context.Context) error {
 	defer c.w.Flush()
 
-	const rmcTimeoutInterval = 5 * time.Minute
-	rmcTimeout := time.NewTimer(rmcTimeoutInterval)
-	defer rmcTimeout.Stop()
+	const positionTimeoutInterval = 5 * time.Minute
+	positionTimeout := time.NewTimer(positionTimeoutInterval)
+	defer positionTimeout.Stop()
 
 	for {
 		select {
-		case line := <-c.c:
-			gpxInputMessages.Inc()
-			sent, err := nmea.Parse(line)
-			if err != nil {
-				if strings.Contains(err.Error(), "not supported") {
-					gpxUnsupportedMessages.Inc()
-					continue
-				}
-				gpxBadMessages.Inc()
-				continue
-			}
-
-			switch sent.DataType() {
-			case nmea.TypeRMC:
-				rmc := sent.(nmea.RMC)
-				if rmc.Latitude == 0 && rmc.Longitude == 0 {
-					continue
-				}
-				rmcTimeout.Reset(rmcTimeoutInterval)
-				when := time.Date(rmc.Date.YY+2000, time.Month(rmc.Date.MM), rmc.Date.DD, rmc.Time.Hour, rmc.Time.Minute, rmc.Time.Second, rmc.Time.Millisecond*int(time.Millisecond), time.UTC)
-				if c.w.Sample(rmc.Latitude, rmc.Longitude, when, c.i.GPXExtensions()) {
-					gpxPositionsRecorded.Inc()
-				}
-				gpxPositionsSampled.Inc()
+		case fix := <-c.c:
+			positionTimeout.Reset(positionTimeoutInterval)
+			if c.w.Sample(fix.Lat, fix.Lon, fix.SampleTime(), c.i.GPXExtensions()) {
+				gpxPositionsRecorded.Inc()
 			}
+			gpxPositionsSampled.Inc()
 
-		case <-rmcTimeout.C:
+		case <-positionTimeout.C:
 			c.w.Flush()
 
 		case <-ctx.Done():
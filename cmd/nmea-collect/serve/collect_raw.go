@@ -35,16 +35,18 @@ type rawCollector struct {
 	window        time.Duration
 	flushInterval time.Duration
 	compress      bool
-	c             <-chan string
+	stripTagBlock bool
+	c             <-chan *Message
 }
 
-func collectRAW(filePat string, bufSize int, window, flushInterval time.Duration, compress bool, c <-chan string) *rawCollector {
+func collectRAW(filePat string, bufSize int, window, flushInterval time.Duration, compress, stripTagBlock bool, c <-chan *Message) *rawCollector {
 	return &rawCollector{
 		filePat:       filePat,
 		bufSize:       bufSize,
 		window:        window,
 		flushInterval: flushInterval,
 		compress:      compress,
+		stripTagBlock: stripTagBlock,
 		c:             c,
 	}
 }
@@ -71,11 +73,21 @@ func (r *rawCollector) Serve(ctx context.Context) error {
 	var day time.Time
 	for {
 		select {
-		case line := <-r.c:
+		case msg := <-r.c:
+			if msg.Source == cpaSource {
+				// Our own CPA alarms aren't received data and don't
+				// belong in the archive.
+				continue
+			}
 			now := time.Now().UTC()
 			truncS := now.Truncate(time.Second)
 			truncDay := now.Truncate(r.window)
 
+			// Time stamps come from the tag block when there is one, while
+			// file rotation always follows our own clock.
+			stamp := msg.Time().UTC()
+			truncStamp := stamp.Truncate(time.Second)
+
 			if !truncDay.Equal(day) {
 				if fd != nil {
 					fd.Close()
@@ -99,12 +111,16 @@ func (r *rawCollector) Serve(ctx context.Context) error {
 				rawFilesCreated.Inc()
 			}
 
-			if !truncS.Equal(lastZDA) {
-				line := fmt.Sprintf("VRZDA,%s,%02d,%02d,%04d,00,00", now.Format("150405.00"), now.Day(), now.Month(), now.Year())
+			if !truncStamp.Equal(lastZDA) {
+				line := fmt.Sprintf("VRZDA,%s,%02d,%02d,%04d,00,00", stamp.Format("150405.00"), stamp.Day(), stamp.Month(), stamp.Year())
 				fmt.Fprintf(fd, "$%s*%s\r\n", line, nmea.Checksum(line))
-				lastZDA = truncS
+				lastZDA = truncStamp
 			}
 
+			line := msg.Line()
+			if r.stripTagBlock {
+				line = msg.Raw
+			}
 			fmt.Fprintf(fd, "%s\r\n", line)
 			rawMessagesRecorded.Inc()
 
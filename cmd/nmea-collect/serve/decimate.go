@@ -0,0 +1,202 @@
+package serve
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BertoldVdb/go-ais"
+	nmea "github.com/adrianmo/go-nmea"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var nmeaDecimateSuppressed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "nmea",
+	Subsystem: "decimate",
+	Name:      "messages_suppressed_total",
+}, []string{"output", "rule"})
+
+// decimator limits the rate of sentences to an output. Each rule is an
+// interval followed by a filter expression, e.g. "5s type:RMC" for at most
+// one RMC per five seconds, or "drop type:GSV" to drop GSV entirely. The
+// first rule whose filter matches a sentence applies to it; sentences
+// matching no rule pass.
+//
+// The interval applies per talker and sentence type, so that "1s
+// type:HDG,HDT" passes one of each per second, and for AIS per MMSI and
+// message type, with the two parts of static data reports (type 24) kept
+// apart. All sentences of a multi-sentence AIS message, or of a sentence
+// group such as GSV, are passed or suppressed together.
+type decimator struct {
+	output string
+	rules  []*decimateRule
+}
+
+type decimateRule struct {
+	spec     string
+	interval time.Duration // zero means drop everything
+	filter   *messageFilter
+
+	passed    map[string]time.Time // key -> when last passed
+	fragments map[string]bool      // key -> whether the current multi-sentence message passes
+	swept     time.Time
+}
+
+// parseDecimator parses the rules for the named output. It returns nil,
+// passing everything, if there are no rules. An empty output name is for
+// validation only and registers no metrics.
+func parseDecimator(output string, specs []string) (*decimator, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	d := &decimator{output: output}
+	for _, spec := range specs {
+		interval, expr, _ := strings.Cut(strings.TrimSpace(spec), " ")
+		r := &decimateRule{
+			spec:      spec,
+			passed:    make(map[string]time.Time),
+			fragments: make(map[string]bool),
+		}
+		if interval != "drop" {
+			var err error
+			r.interval, err = time.ParseDuration(interval)
+			if err != nil || r.interval <= 0 {
+				return nil, fmt.Errorf("decimation rule %q: interval must be a positive duration or \"drop\"", spec)
+			}
+		}
+		if strings.TrimSpace(expr) == "" {
+			return nil, fmt.Errorf("decimation rule %q: missing filter expression", spec)
+		}
+		f, err := parseFilter("", expr)
+		if err != nil {
+			return nil, fmt.Errorf("decimation rule %q: %w", spec, err)
+		}
+		r.filter = f
+		d.rules = append(d.rules, r)
+		if output != "" {
+			nmeaDecimateSuppressed.WithLabelValues(output, spec)
+		}
+	}
+	return d, nil
+}
+
+// Pass returns true if the message should be sent. A nil decimator passes
+// everything.
+func (d *decimator) Pass(msg *Message) bool {
+	if d == nil {
+		return true
+	}
+	for _, r := range d.rules {
+		if !r.filter.Match(msg) {
+			continue
+		}
+		if !r.pass(msg) {
+			nmeaDecimateSuppressed.WithLabelValues(d.output, r.spec).Inc()
+			return false
+		}
+		return true
+	}
+	return true
+}
+
+func (r *decimateRule) pass(msg *Message) bool {
+	if r.interval == 0 {
+		return false
+	}
+
+	key, fragment, last := decimateKey(msg)
+	if fragment > 1 {
+		// Later sentences follow the decision for the first one.
+		ok := r.fragments[key]
+		if last {
+			delete(r.fragments, key)
+		}
+		return ok
+	}
+
+	now := msg.Received
+	r.sweep(now)
+	ok := now.Sub(r.passed[key]) >= r.interval
+	if ok {
+		r.passed[key] = now
+	}
+	if fragment == 1 && !last {
+		r.fragments[key] = ok
+	}
+	return ok
+}
+
+// sweep forgets keys that haven't passed in a while, as they no longer
+// affect anything.
+func (r *decimateRule) sweep(now time.Time) {
+	if now.Sub(r.swept) < time.Minute {
+		return
+	}
+	r.swept = now
+	for key, t := range r.passed {
+		if now.Sub(t) >= r.interval {
+			delete(r.passed, key)
+		}
+	}
+}
+
+// groupSentences are the sentence types sent as groups of several
+// sentences, with the number of sentences and the sentence number as the
+// first two fields.
+var groupSentences = map[string]bool{"GSV": true, "RTE": true, "TXT": true}
+
+// decimateKey returns the key to rate limit the message by, and for AIS
+// and sentence groups such as GSV the fragment number and whether it's
+// the last fragment.
+func decimateKey(msg *Message) (key string, fragment int64, last bool) {
+	talker, typ := sentenceAddress(msg.Raw)
+	key = talker + typ
+	hdr, ok := msg.AISHeader()
+	if !ok {
+		if groupSentences[typ] {
+			if number, total, ok := sentenceGroupPart(msg.Raw); ok {
+				return key, number, number == total
+			}
+		}
+		return key, 0, true
+	}
+	key += "/" + strconv.FormatUint(uint64(hdr.UserID), 10) + "/" + strconv.Itoa(int(hdr.MessageID))
+	if sdr, ok := msg.AIS().(ais.StaticDataReport); ok {
+		// Part A has the name and part B the call sign and dimensions;
+		// neither replaces the other.
+		if sdr.PartNumber {
+			key += "/B"
+		} else {
+			key += "/A"
+		}
+	}
+	if sent, err := msg.Sentence(); err == nil {
+		if vdmvdo, ok := sent.(nmea.VDMVDO); ok {
+			return key, vdmvdo.FragmentNumber, vdmvdo.FragmentNumber == vdmvdo.NumFragments
+		}
+	}
+	return key, 0, true
+}
+
+// sentenceGroupPart returns the sentence number and the number of
+// sentences in the group from the first two fields of the sentence.
+func sentenceGroupPart(raw string) (number, total int64, ok bool) {
+	if idx := strings.IndexByte(raw, '*'); idx >= 0 {
+		raw = raw[:idx]
+	}
+	fields := strings.SplitN(raw, ",", 4)
+	if len(fields) < 3 {
+		return 0, 0, false
+	}
+	total, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	number, err = strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || number < 1 || number > total {
+		return 0, 0, false
+	}
+	return number, total, true
+}
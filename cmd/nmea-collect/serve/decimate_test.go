@@ -0,0 +1,121 @@
+package serve
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDecimator(t *testing.T) {
+	d, err := parseDecimator("test", []string{"5s type:RMC", "drop type:GSV", "1m prefix:!AI"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t0 := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	at := func(offset time.Duration, line string) *Message {
+		msg := acceptLine("test", line)
+		msg.Received = t0.Add(offset)
+		return msg
+	}
+	const (
+		rmc = "$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6A"
+		gsv = "$GPGSV,1,1,00*79"
+		gga = "$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*47"
+		pos = "!AIVDM,1,1,,A,1>M;`h>P00PjFb0PWIh>4?wp0000,0*03"
+	)
+
+	cases := []struct {
+		offset time.Duration
+		line   string
+		pass   bool
+	}{
+		{0, rmc, true},
+		{time.Second, rmc, false},
+		{5 * time.Second, rmc, true},
+		{8 * time.Second, `\c:1577836800*58\` + rmc, false}, // tag block time doesn't matter
+		{10 * time.Second, `\c:1577836800*58\` + rmc, true},
+		{6 * time.Second, gsv, false},
+		{6 * time.Second, gga, true},
+		{6 * time.Second, gga, true},
+		{0, pos, true},
+		{30 * time.Second, pos, false},
+		{61 * time.Second, pos, true},
+	}
+	for i, tc := range cases {
+		if got := d.Pass(at(tc.offset, tc.line)); got != tc.pass {
+			t.Errorf("%d: %s at %v: got %v, want %v", i, tc.line, tc.offset, got, tc.pass)
+		}
+	}
+}
+
+func TestDecimatorFragments(t *testing.T) {
+	d, err := parseDecimator("test", []string{"1m ais:5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := assembleAIS(nil, nil, time.Minute)
+	a.pending = make(map[aisFragmentKey]*aisFragments)
+
+	for i, want := range []bool{true, false} {
+		first := acceptLine("test", "!AIVDM,2,1,4,B,55WilF81SCLtcP;;K?9<4r18Dlv20000000000166pA7453V0:21C31,0*5D")
+		second := acceptLine("test", "!AIVDM,2,2,4,B,BjDh000000000000,2*17")
+		a.process(first)
+		a.process(second)
+		if d.Pass(first) != want || d.Pass(second) != want {
+			t.Errorf("%d: both sentences should pass %v", i, want)
+		}
+	}
+}
+
+func TestDecimatorStaticDataParts(t *testing.T) {
+	d, err := parseDecimator("test", []string{"1m prefix:!AI"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Parts A and B of a type 24 static data report, from the same MMSI.
+	t0 := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i, want := range []bool{true, false} {
+		for _, line := range []string{
+			"!AIVDM,1,1,,A,H42O55i18tMET00000000000000,2*6D",
+			"!AIVDM,1,1,,A,H42O55lti4hhhilD3nink000?050,0*40",
+		} {
+			msg := acceptLine("test", line)
+			msg.Received = t0.Add(time.Duration(i) * 10 * time.Second)
+			if got := d.Pass(msg); got != want {
+				t.Errorf("%d: %s: got %v, want %v", i, line, got, want)
+			}
+		}
+	}
+}
+
+func TestDecimatorErrors(t *testing.T) {
+	for _, rule := range []string{"type:RMC", "5s", "-1s type:RMC", "5s foo:bar"} {
+		if _, err := parseDecimator("test", []string{rule}); err == nil {
+			t.Errorf("%q should be an error", rule)
+		}
+	}
+}
+
+func TestDecimatorGroups(t *testing.T) {
+	d, err := parseDecimator("test", []string{"5s type:GSV"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t0 := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	const (
+		gsv1 = "$GPGSV,2,1,08,01,40,083,46,02,17,308,41,12,07,344,39,14,22,228,45*75"
+		gsv2 = "$GPGSV,2,2,08,15,10,100,38,17,05,200,30,19,60,010,44,22,33,150,42*71"
+	)
+	for i, want := range []bool{true, false, true} {
+		offset := time.Duration(i) * 3 * time.Second
+		first := acceptLine("test", gsv1)
+		first.Received = t0.Add(offset)
+		second := acceptLine("test", gsv2)
+		second.Received = t0.Add(offset + 100*time.Millisecond)
+		if d.Pass(first) != want || d.Pass(second) != want {
+			t.Errorf("%d: both sentences should pass %v", i, want)
+		}
+	}
+}
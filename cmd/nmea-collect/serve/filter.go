@@ -0,0 +1,224 @@
+package serve
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var nmeaFilterMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "nmea",
+	Subsystem: "filter",
+	Name:      "messages_total",
+}, []string{"filter", "result"})
+
+// messageFilter decides which messages pass to an output. A filter
+// expression is a space separated list of terms, all of which must match.
+// A term is a key and a comma separated list of values, of which any may
+// match, optionally negated with a leading "!":
+//
+//	prefix:!AI,$GP   the sentence starts with one of the strings
+//	talker:GP,II     the talker ID ("P" for proprietary sentences)
+//	type:RMC,GGA     the sentence type (e.g., "CDIN" for "$PCDIN")
+//	re:^\$..XDR      the sentence matches the regular expression; the
+//	                 value is not split on commas
+//	source:tcp/*     the input, as a glob pattern (see path.Match)
+//	ais:1,2,3,18     the AIS message type
+//	mmsi:265123456   the AIS MMSI
+//
+// For example, "!type:GSV,GSA" passes everything except satellite info,
+// and "ais:1,2,3,18 !mmsi:265123456" passes position reports from others
+// than ourselves. The ais and mmsi terms never match non-AIS sentences.
+// An empty expression passes everything.
+type messageFilter struct {
+	name  string
+	expr  string
+	terms []filterTerm
+}
+
+type filterTerm struct {
+	negate bool
+	match  func(*Message) bool
+}
+
+// parseFilter parses the filter expression. The name labels the filter's
+// metrics. Terms are separated by white space, without any quoting, so a
+// regular expression must use \s or similar to match a space.
+func parseFilter(name, expr string) (*messageFilter, error) {
+	f := &messageFilter{name: name, expr: expr}
+	for _, field := range strings.Fields(expr) {
+		term, err := parseFilterTerm(field)
+		if err != nil {
+			return nil, fmt.Errorf("filter %q: %w", expr, err)
+		}
+		f.terms = append(f.terms, term)
+	}
+	if name != "" {
+		nmeaFilterMessages.WithLabelValues(name, "hit")
+		nmeaFilterMessages.WithLabelValues(name, "miss")
+	}
+	return f, nil
+}
+
+// mustParseFilter is like parseFilter, for expressions known to be valid.
+func mustParseFilter(name, expr string) *messageFilter {
+	f, err := parseFilter(name, expr)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+func (f *messageFilter) String() string {
+	return f.expr
+}
+
+// Match returns true if the message passes the filter. A nil filter
+// passes everything.
+func (f *messageFilter) Match(msg *Message) bool {
+	if f == nil {
+		return true
+	}
+	ok := f.match(msg)
+	if f.name != "" {
+		if ok {
+			nmeaFilterMessages.WithLabelValues(f.name, "hit").Inc()
+		} else {
+			nmeaFilterMessages.WithLabelValues(f.name, "miss").Inc()
+		}
+	}
+	return ok
+}
+
+func (f *messageFilter) match(msg *Message) bool {
+	for _, t := range f.terms {
+		if t.match(msg) == t.negate {
+			return false
+		}
+	}
+	return true
+}
+
+func parseFilterTerm(s string) (filterTerm, error) {
+	var term filterTerm
+	if strings.HasPrefix(s, "!") {
+		term.negate = true
+		s = s[1:]
+	}
+	key, value, ok := strings.Cut(s, ":")
+	if !ok || value == "" {
+		return filterTerm{}, fmt.Errorf("term %q is not on the form key:values", s)
+	}
+
+	if key == "re" {
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return filterTerm{}, fmt.Errorf("term %q: %w", s, err)
+		}
+		term.match = func(msg *Message) bool { return re.MatchString(msg.Raw) }
+		return term, nil
+	}
+
+	values := strings.Split(value, ",")
+	switch key {
+	case "prefix":
+		term.match = func(msg *Message) bool {
+			for _, v := range values {
+				if strings.HasPrefix(msg.Raw, v) {
+					return true
+				}
+			}
+			return false
+		}
+
+	case "talker", "type":
+		set := make(map[string]bool, len(values))
+		for _, v := range values {
+			set[v] = true
+		}
+		talker := key == "talker"
+		term.match = func(msg *Message) bool {
+			t, typ := sentenceAddress(msg.Raw)
+			if talker {
+				return set[t]
+			}
+			return set[typ]
+		}
+
+	case "source":
+		for _, v := range values {
+			if _, err := path.Match(v, ""); err != nil {
+				return filterTerm{}, fmt.Errorf("term %q: %w", s, err)
+			}
+		}
+		term.match = func(msg *Message) bool {
+			for _, v := range values {
+				if ok, _ := path.Match(v, msg.Source); ok {
+					return true
+				}
+			}
+			return false
+		}
+
+	case "ais", "mmsi":
+		set := make(map[uint32]bool, len(values))
+		for _, v := range values {
+			n, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return filterTerm{}, fmt.Errorf("term %q: bad number %q", s, v)
+			}
+			set[uint32(n)] = true
+		}
+		mmsi := key == "mmsi"
+		term.match = func(msg *Message) bool {
+			hdr, ok := msg.AISHeader()
+			if !ok {
+				return false
+			}
+			if mmsi {
+				return set[hdr.UserID]
+			}
+			return set[uint32(hdr.MessageID)]
+		}
+
+	default:
+		return filterTerm{}, fmt.Errorf("term %q: unknown key %q", s, key)
+	}
+	return term, nil
+}
+
+// checkSentenceTypes returns an error if any of the strings isn't usable
+// as a sentence type, e.g. "RMB", or "GRMZ" for "$PGRMZ".
+func checkSentenceTypes(types []string) error {
+	for _, typ := range types {
+		if typ == "" || strings.ContainsAny(typ, ",:!* \t") {
+			return fmt.Errorf("bad sentence type %q", typ)
+		}
+	}
+	return nil
+}
+
+// sentenceAddress returns the talker ID and sentence type of the sentence.
+// Proprietary sentences have the talker "P" and the rest of the address
+// as type.
+func sentenceAddress(raw string) (talker, typ string) {
+	if len(raw) < 2 || (raw[0] != '$' && raw[0] != '!') {
+		return "", ""
+	}
+	addr := raw[1:]
+	if idx := strings.IndexAny(addr, ",*"); idx >= 0 {
+		addr = addr[:idx]
+	}
+	if strings.HasPrefix(addr, "P") {
+		return "P", addr[1:]
+	}
+	if len(addr) < 3 {
+		return "", ""
+	}
+	return addr[:2], addr[2:]
+}
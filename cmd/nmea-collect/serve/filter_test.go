@@ -0,0 +1,77 @@
+package serve
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFilter(t *testing.T) {
+	rmc := acceptLine("tcp/172.16.1.2:2000", "$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6A")
+	gsv := acceptLine("udp/2000", "$GPGSV,1,1,00*79")
+	din := acceptLine("udp/2000", "$PCDIN,01F214,47B319FE,55,00C8040000FFFFC4*51")
+	pos := acceptLine("udp/2000", "!AIVDM,1,1,,A,1>M;`h>P00PjFb0PWIh>4?wp0000,0*03")
+
+	cases := []struct {
+		expr  string
+		match []*Message
+	}{
+		{"", []*Message{rmc, gsv, din, pos}},
+		{"prefix:!AI", []*Message{pos}},
+		{"prefix:!AI,$GPR", []*Message{rmc, pos}},
+		{"!type:GSV,GSA", []*Message{rmc, din, pos}},
+		{"talker:P", []*Message{din}},
+		{"type:CDIN", []*Message{din}},
+		{"talker:GP !type:GSV", []*Message{rmc}},
+		{`re:^\$..R`, []*Message{rmc}},
+		{"source:tcp/*", []*Message{rmc}},
+		{"!source:udp/*", []*Message{rmc}},
+		{"ais:1,2,3,18", []*Message{pos}},
+		{"ais:5", nil},
+		{"!ais:1", []*Message{rmc, gsv, din}},
+		{"mmsi:970123456", []*Message{pos}},
+		{"prefix:! !mmsi:970123456", nil},
+	}
+	for _, tc := range cases {
+		f, err := parseFilter("", tc.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range []*Message{rmc, gsv, din, pos} {
+			want := false
+			for _, m := range tc.match {
+				want = want || m == msg
+			}
+			if got := f.Match(msg); got != want {
+				t.Errorf("%q on %s: got %v, want %v", tc.expr, msg.Raw, got, want)
+			}
+		}
+	}
+}
+
+func TestFilterFragments(t *testing.T) {
+	// Both sentences of a multi-sentence message pass an AIS filter, not
+	// only the last one that carries the full packet.
+	a := assembleAIS(nil, nil, time.Minute)
+	a.pending = make(map[aisFragmentKey]*aisFragments)
+	first := acceptLine("test", "!AIVDM,2,1,4,B,55WilF81SCLtcP;;K?9<4r18Dlv20000000000166pA7453V0:21C31,0*5D")
+	second := acceptLine("test", "!AIVDM,2,2,4,B,BjDh000000000000,2*17")
+	a.process(first)
+	a.process(second)
+
+	mmsi := second.AIS().GetHeader().UserID
+	for _, expr := range []string{"ais:5", "mmsi:" + strconv.FormatUint(uint64(mmsi), 10)} {
+		f := mustParseFilter("", expr)
+		if !f.Match(first) || !f.Match(second) {
+			t.Errorf("%q should match both fragments", expr)
+		}
+	}
+}
+
+func TestFilterErrors(t *testing.T) {
+	for _, expr := range []string{"type", "foo:bar", "re:(", "ais:x", "mmsi:-1", "source:[", "type:"} {
+		if _, err := parseFilter("", expr); err == nil {
+			t.Errorf("%q should be an error", expr)
+		}
+	}
+}
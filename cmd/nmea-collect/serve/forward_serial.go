@@ -0,0 +1,235 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	serialOutputMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nmea",
+		Subsystem: "serial_output",
+		Name:      "messages_total",
+	}, []string{"dev"})
+	serialOutputBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nmea",
+		Subsystem: "serial_output",
+		Name:      "bytes_total",
+	}, []string{"dev"})
+	serialOutputDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nmea",
+		Subsystem: "serial_output",
+		Name:      "dropped_messages_total",
+	}, []string{"dev"})
+	serialOutputQueued = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nmea",
+		Subsystem: "serial_output",
+		Name:      "queued_bytes",
+	}, []string{"dev"})
+)
+
+// serialForwarder writes sentences to a serial device, at no more than
+// the port's speed. Sentences wait at most maxDelay for the port; when
+// there's more than that, the lowest priority sentences are dropped,
+// oldest first. Of the queued sentences, the highest priority ones are
+// written first.
+type serialForwarder struct {
+	input      <-chan *Message
+	cfg        serialConfig
+	open       func() (io.WriteCloser, error)
+	priorities map[string]int // sentence type -> priority, lower is more important
+	maxDelay   time.Duration
+	decimate   *decimator
+}
+
+// forwardSerial returns a forwarder for the device. Sentences of the
+// types in priority are more important than others, in the order given.
+func forwardSerial(input <-chan *Message, cfg serialConfig, priority []string, maxDelay time.Duration, decimate *decimator) *serialForwarder {
+	priorities := make(map[string]int, len(priority))
+	for i, typ := range priority {
+		if _, ok := priorities[typ]; !ok {
+			priorities[typ] = i
+		}
+	}
+	return &serialForwarder{
+		input:      input,
+		cfg:        cfg,
+		open:       func() (io.WriteCloser, error) { return openSerialOutput(cfg) },
+		priorities: priorities,
+		maxDelay:   maxDelay,
+		decimate:   decimate,
+	}
+}
+
+func (f *serialForwarder) String() string {
+	return fmt.Sprintf("serial-forwarder(%s)@%p", f.cfg, f)
+}
+
+func (f *serialForwarder) Serve(ctx context.Context) error {
+	w, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	dev := f.cfg.dev
+	serialOutputMessages.WithLabelValues(dev)
+	serialOutputBytes.WithLabelValues(dev)
+	serialOutputDropped.WithLabelValues(dev)
+	serialOutputQueued.WithLabelValues(dev)
+
+	rate := f.cfg.bytesPerSecond()
+	q := newSerialQueue(int(rate * f.maxDelay.Seconds()))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errC := make(chan error, 1)
+	go func() {
+		errC <- f.write(ctx, w, q, rate)
+	}()
+
+	for {
+		select {
+		case msg := <-f.input:
+			if !f.decimate.Pass(msg) {
+				continue
+			}
+			dropped := q.put(msg.Raw+"\r\n", f.priority(msg))
+			serialOutputDropped.WithLabelValues(dev).Add(float64(dropped))
+			serialOutputQueued.WithLabelValues(dev).Set(float64(q.len()))
+
+		case err := <-errC:
+			return err
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// write sends queued lines to the device, pacing them to the port speed so
+// that they queue with us rather than in the device driver.
+func (f *serialForwarder) write(ctx context.Context, w io.Writer, q *serialQueue, rate float64) error {
+	dev := f.cfg.dev
+	next := time.Now()
+	for {
+		if d := time.Until(next); d > 0 {
+			select {
+			case <-time.After(d):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		line, ok := q.get()
+		if !ok {
+			select {
+			case <-q.ready:
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		serialOutputQueued.WithLabelValues(dev).Set(float64(q.len()))
+
+		n, err := io.WriteString(w, line)
+		serialOutputBytes.WithLabelValues(dev).Add(float64(n))
+		if err != nil {
+			return err
+		}
+		serialOutputMessages.WithLabelValues(dev).Inc()
+		next = time.Now().Add(time.Duration(float64(n) / rate * float64(time.Second)))
+	}
+}
+
+func (f *serialForwarder) priority(msg *Message) int {
+	_, typ := sentenceAddress(msg.Raw)
+	if p, ok := f.priorities[typ]; ok {
+		return p
+	}
+	return len(f.priorities)
+}
+
+// serialQueue holds lines waiting to be written, up to a maximum number
+// of bytes.
+type serialQueue struct {
+	mut   sync.Mutex
+	lines []serialLine // in order of arrival
+	size  int
+	max   int
+	ready chan struct{} // signalled when a line is added
+}
+
+type serialLine struct {
+	line     string
+	priority int
+}
+
+func newSerialQueue(max int) *serialQueue {
+	return &serialQueue{max: max, ready: make(chan struct{}, 1)}
+}
+
+// put adds the line, dropping lines of the lowest priority to make room.
+// If all queued lines are more important than the new one, it is dropped
+// instead. It returns the number of lines dropped.
+func (q *serialQueue) put(line string, priority int) int {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	dropped := 0
+	for q.size+len(line) > q.max {
+		victim := -1
+		for i, l := range q.lines {
+			if l.priority >= priority && (victim < 0 || l.priority > q.lines[victim].priority) {
+				victim = i
+			}
+		}
+		if victim < 0 {
+			return dropped + 1
+		}
+		q.size -= len(q.lines[victim].line)
+		q.lines = append(q.lines[:victim], q.lines[victim+1:]...)
+		dropped++
+	}
+
+	q.lines = append(q.lines, serialLine{line: line, priority: priority})
+	q.size += len(line)
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return dropped
+}
+
+// get removes and returns the oldest of the most important lines.
+func (q *serialQueue) get() (string, bool) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	if len(q.lines) == 0 {
+		return "", false
+	}
+	next := 0
+	for i, l := range q.lines {
+		if l.priority < q.lines[next].priority {
+			next = i
+		}
+	}
+	line := q.lines[next].line
+	q.size -= len(line)
+	q.lines = append(q.lines[:next], q.lines[next+1:]...)
+	return line, true
+}
+
+// len returns the number of bytes queued.
+func (q *serialQueue) len() int {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	return q.size
+}
@@ -0,0 +1,94 @@
+package serve
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestSerialQueue(t *testing.T) {
+	// Room for three lines of ten bytes
+	q := newSerialQueue(30)
+
+	put := func(line string, priority, wantDropped int) {
+		t.Helper()
+		if dropped := q.put(line, priority); dropped != wantDropped {
+			t.Errorf("put(%q, %d) dropped %d, expected %d", line, priority, dropped, wantDropped)
+		}
+	}
+	put("low-0....\n", 2, 0)
+	put("high-0...\n", 0, 0)
+	put("low-1....\n", 2, 0)
+	put("mid-0....\n", 1, 1) // drops low-0, the oldest of the lowest priority
+	put("low-2....\n", 2, 1) // drops low-1, in favor of the newer one
+	put("high-1...\n", 0, 1) // drops low-2
+	put("mid-1....\n", 1, 1) // drops mid-0
+	put("low-3....\n", 2, 1) // everything else is more important
+
+	// Lines come out in order of priority, then age.
+	var got []string
+	for {
+		line, ok := q.get()
+		if !ok {
+			break
+		}
+		got = append(got, line)
+	}
+	want := []string{"high-0...\n", "high-1...\n", "mid-1....\n"}
+	if len(got) != len(want) {
+		t.Fatalf("got %q, expected %q", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("got %q, expected %q", got, want)
+			break
+		}
+	}
+	if q.len() != 0 {
+		t.Errorf("queue should be empty, has %d bytes", q.len())
+	}
+}
+
+func TestSerialForwarder(t *testing.T) {
+	cfg, err := parseSerialOutputConfig("/dev/test@115200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := make(chan *Message, 10)
+	pr, pw := io.Pipe()
+	f := forwardSerial(input, cfg, []string{"RMB"}, time.Second, nil)
+	f.open = func() (io.WriteCloser, error) { return pw, nil }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go f.Serve(ctx)
+
+	const rmb = "$GPRMB,A,0.66,L,003,004,4917.24,N,12309.57,W,001.3,052.5,000.5,V*20"
+	input <- acceptLine("test", `\c:1577836800*58\`+rmb)
+
+	br := bufio.NewReader(pr)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != rmb+"\r\n" {
+		t.Errorf("got %q, expected %q", line, rmb+"\r\n")
+	}
+}
+
+func TestParseSerialOutputConfig(t *testing.T) {
+	for _, in := range []string{"/dev/ttyUSB0", "/dev/ttyUSB0@auto"} {
+		if _, err := parseSerialOutputConfig(in); err == nil {
+			t.Errorf("parseSerialOutputConfig(%q) should fail", in)
+		}
+	}
+	cfg, err := parseSerialOutputConfig("/dev/ttyUSB0@4800")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bps := cfg.bytesPerSecond(); bps != 480 {
+		t.Errorf("4800 baud 8N1 is %v bytes per second, expected 480", bps)
+	}
+}
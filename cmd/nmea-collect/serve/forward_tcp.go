@@ -10,6 +10,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/thejerf/suture/v4"
+	"golang.org/x/exp/slog"
 )
 
 var (
@@ -28,21 +29,73 @@ var (
 		Subsystem: "tcp",
 		Name:      "current_connections",
 	}, []string{"source"})
+	tcpClientQueued = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nmea",
+		Subsystem: "tcp",
+		Name:      "client_queued_messages",
+	}, []string{"source", "client"})
+	tcpClientDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nmea",
+		Subsystem: "tcp",
+		Name:      "client_dropped_messages_total",
+	}, []string{"source", "client"})
+	tcpClientSentBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nmea",
+		Subsystem: "tcp",
+		Name:      "client_sent_bytes_total",
+	}, []string{"source", "client"})
+	tcpClientConnectedSince = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nmea",
+		Subsystem: "tcp",
+		Name:      "client_connected_since_seconds",
+	}, []string{"source", "client"})
 )
 
+// tcpClientQueueSize is how many lines we buffer for each client.
+const tcpClientQueueSize = 1024
+
+// tcpClientMaxLag is how long a client's queue may stay full, with lines
+// being dropped, before we disconnect it.
+const tcpClientMaxLag = 10 * time.Second
+
+// tcpClientWriteTimeout is how long a single write to a client may take.
+const tcpClientWriteTimeout = 30 * time.Second
+
+// tcpForwarder sends every message to all connected clients. Each client
+// has its own queue and writer, so that a slow client doesn't hold up the
+// others.
 type tcpForwarder struct {
-	input <-chan string
-	addr  string
-	conns []net.Conn
-	mut   sync.Mutex
+	input         <-chan *Message
+	addr          string
+	stripTagBlock bool
+	decimate      *decimator
+	inject        *tcpInjector // nil if clients may not send to us
+	replay        *replayCache // nil if new clients get only live data
+	clients       map[*tcpClient]struct{}
+	mut           sync.Mutex
 	suture.Service
 }
 
-func forwardTCP(input <-chan string, addr string) suture.Service {
+type tcpClient struct {
+	conn   net.Conn
+	addr   string
+	queue  chan string
+	since  time.Time
+	full   time.Time // when the queue became full, or zero
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func forwardTCP(input <-chan *Message, addr string, stripTagBlock bool, decimate *decimator, inject *tcpInjector, replayMaxAge time.Duration) suture.Service {
 	sup := suture.NewSimple("tcp-forwarder-supervisor/" + addr)
 	f := &tcpForwarder{
-		input: input,
-		addr:  addr,
+		input:         input,
+		addr:          addr,
+		stripTagBlock: stripTagBlock,
+		decimate:      decimate,
+		inject:        inject,
+		replay:        newReplayCache(addr, replayMaxAge),
+		clients:       make(map[*tcpClient]struct{}),
 	}
 	sup.Add(f)
 	l := &tcpListener{
@@ -58,9 +111,38 @@ func (f *tcpForwarder) String() string {
 }
 
 func (f *tcpForwarder) addConn(conn net.Conn) {
+	c := &tcpClient{
+		conn:  conn,
+		addr:  conn.RemoteAddr().String(),
+		since: time.Now(),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	tcpClientQueued.WithLabelValues(f.addr, c.addr)
+	tcpClientDropped.WithLabelValues(f.addr, c.addr)
+	tcpClientSentBytes.WithLabelValues(f.addr, c.addr)
+	tcpClientConnectedSince.WithLabelValues(f.addr, c.addr).Set(float64(c.since.Unix()))
+	if f.inject != nil {
+		for _, result := range []string{"injected", "rejected", "no-output"} {
+			tcpClientInjected.WithLabelValues(f.addr, c.addr, result)
+		}
+	}
+
+	// The client starts with the cached sentences. Taking the snapshot
+	// under the lock means nothing is sent in between.
 	f.mut.Lock()
-	f.conns = append(f.conns, conn)
+	replay := f.replay.snapshot(c.since)
+	c.queue = make(chan string, tcpClientQueueSize+len(replay))
+	for _, line := range replay {
+		c.queue <- line
+	}
+	f.clients[c] = struct{}{}
+	tcpCurrentConnections.WithLabelValues(f.addr).Set(float64(len(f.clients)))
 	f.mut.Unlock()
+
+	go f.write(c)
+	if f.inject != nil {
+		go f.read(c)
+	}
 }
 
 func (f *tcpForwarder) Serve(ctx context.Context) error {
@@ -69,26 +151,113 @@ func (f *tcpForwarder) Serve(ctx context.Context) error {
 
 	for {
 		select {
-		case line := <-f.input:
-			f.mut.Lock()
-			for i := 0; i < len(f.conns); i++ {
-				_ = f.conns[i].SetWriteDeadline(time.Now().Add(time.Second))
-				if _, err := fmt.Fprintf(f.conns[i], "%s\n", line); err != nil {
-					_ = f.conns[i].Close()
-					f.conns = append(f.conns[:i], f.conns[i+1:]...)
-					i--
-				}
-				tcpForwardedMessages.WithLabelValues(f.addr).Inc()
+		case msg := <-f.input:
+			if !f.decimate.Pass(msg) {
+				continue
 			}
-			tcpCurrentConnections.WithLabelValues(f.addr).Set(float64(len(f.conns)))
-			f.mut.Unlock()
+			line := msg.Line()
+			if f.stripTagBlock {
+				line = msg.Raw
+			}
+			f.replay.add(msg, line)
+			f.send(line, msg.origin, time.Now())
 
 		case <-ctx.Done():
+			f.mut.Lock()
+			for c := range f.clients {
+				f.removeLocked(c)
+			}
+			f.mut.Unlock()
 			return ctx.Err()
 		}
 	}
 }
 
+// send queues the line to every client except the one it came from, if
+// any, disconnecting clients whose queue has been full for too long.
+func (f *tcpForwarder) send(line string, origin any, now time.Time) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	for c := range f.clients {
+		if c == origin {
+			continue
+		}
+		select {
+		case c.queue <- line:
+			c.full = time.Time{}
+		default:
+			tcpClientDropped.WithLabelValues(f.addr, c.addr).Inc()
+			if c.full.IsZero() {
+				c.full = now
+			} else if now.Sub(c.full) > tcpClientMaxLag {
+				slog.Warn("Disconnecting slow TCP client", "listen", f.addr, "client", c.addr)
+				f.removeLocked(c)
+				continue
+			}
+		}
+		tcpClientQueued.WithLabelValues(f.addr, c.addr).Set(float64(len(c.queue)))
+	}
+}
+
+// write sends queued lines to the client, batching what's available,
+// until the queue is closed or a write fails.
+func (f *tcpForwarder) write(c *tcpClient) {
+	var buf []byte
+	for line := range c.queue {
+		buf = append(buf[:0], line...)
+		buf = append(buf, '\n')
+		lines := 1
+	batch:
+		for len(buf) < 65536 {
+			select {
+			case line, ok := <-c.queue:
+				if !ok {
+					break batch
+				}
+				buf = append(buf, line...)
+				buf = append(buf, '\n')
+				lines++
+			default:
+				break batch
+			}
+		}
+
+		_ = c.conn.SetWriteDeadline(time.Now().Add(tcpClientWriteTimeout))
+		n, err := c.conn.Write(buf)
+		tcpClientSentBytes.WithLabelValues(f.addr, c.addr).Add(float64(n))
+		if err != nil {
+			f.remove(c)
+			return
+		}
+		tcpForwardedMessages.WithLabelValues(f.addr).Add(float64(lines))
+		tcpClientQueued.WithLabelValues(f.addr, c.addr).Set(float64(len(c.queue)))
+	}
+}
+
+func (f *tcpForwarder) remove(c *tcpClient) {
+	f.mut.Lock()
+	f.removeLocked(c)
+	f.mut.Unlock()
+}
+
+// removeLocked disconnects the client, if it's still connected. The
+// caller must hold the lock.
+func (f *tcpForwarder) removeLocked(c *tcpClient) {
+	if _, ok := f.clients[c]; !ok {
+		return
+	}
+	delete(f.clients, c)
+	close(c.queue)
+	c.cancel()
+	_ = c.conn.Close()
+	tcpClientQueued.DeleteLabelValues(f.addr, c.addr)
+	tcpClientDropped.DeleteLabelValues(f.addr, c.addr)
+	tcpClientSentBytes.DeleteLabelValues(f.addr, c.addr)
+	tcpClientConnectedSince.DeleteLabelValues(f.addr, c.addr)
+	tcpClientInjected.DeletePartialMatch(prometheus.Labels{"source": f.addr, "client": c.addr})
+	tcpCurrentConnections.WithLabelValues(f.addr).Set(float64(len(f.clients)))
+}
+
 type tcpListener struct {
 	addr      string
 	forwarder *tcpForwarder
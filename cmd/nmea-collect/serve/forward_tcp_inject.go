@@ -0,0 +1,102 @@
+package serve
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var tcpClientInjected = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "nmea",
+	Subsystem: "tcp",
+	Name:      "client_injected_messages_total",
+}, []string{"source", "client", "result"})
+
+// tcpInjector accepts sentences sent to us by TCP forward clients, such as
+// autopilot sentences from a chart plotter. Sentences are validated like
+// any input and, if of an allowed type, sent to the pipeline input or
+// directly to a named output of the main tee. Via the input they reach every output,
+// including raw files and other TCP clients, but aren't echoed back to
+// the client that sent them.
+type tcpInjector struct {
+	allow  *messageFilter
+	input  chan<- *Message
+	tee    *Tee
+	output string // the output of tee to send to, or empty for input
+}
+
+// newTCPInjector returns an injector for the given sentence types (e.g.,
+// "RMB", or "GRMZ" for "$PGRMZ"), or nil if there are none.
+func newTCPInjector(types []string, input chan<- *Message, tee *Tee, output string) (*tcpInjector, error) {
+	if len(types) == 0 {
+		if output != "" {
+			return nil, fmt.Errorf("inject output %q given without sentence types", output)
+		}
+		return nil, nil
+	}
+	if err := checkSentenceTypes(types); err != nil {
+		return nil, fmt.Errorf("inject: %w", err)
+	}
+	return &tcpInjector{
+		allow:  mustParseFilter("", "type:"+strings.Join(types, ",")),
+		input:  input,
+		tee:    tee,
+		output: output,
+	}, nil
+}
+
+// deliver passes on the message, returning false if the output doesn't
+// exist.
+func (i *tcpInjector) deliver(ctx context.Context, msg *Message) (bool, error) {
+	if i.output != "" {
+		return i.tee.Inject(ctx, i.output, msg)
+	}
+	select {
+	case i.input <- msg:
+		return true, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// read injects the sentences sent by the client, until it's disconnected
+// or closes its side of the connection.
+func (f *tcpForwarder) read(c *tcpClient) {
+	host, _, err := net.SplitHostPort(c.addr)
+	if err != nil {
+		host = c.addr
+	}
+	source := fmt.Sprintf("tcp-forward/%s/%s", f.addr, host)
+	registerInputMetrics(source)
+
+	sc := bufio.NewScanner(c.conn)
+	sc.Buffer(make([]byte, 0, 65536), 65536)
+	for sc.Scan() {
+		msg := acceptLine(source, sc.Text())
+		if msg == nil {
+			continue
+		}
+		if !f.inject.allow.Match(msg) {
+			tcpClientInjected.WithLabelValues(f.addr, c.addr, "rejected").Inc()
+			continue
+		}
+		msg.origin = c // not to be echoed back
+		ok, err := f.inject.deliver(c.ctx, msg)
+		if err != nil {
+			return
+		}
+		if !ok {
+			tcpClientInjected.WithLabelValues(f.addr, c.addr, "no-output").Inc()
+			continue
+		}
+		tcpClientInjected.WithLabelValues(f.addr, c.addr, "injected").Inc()
+	}
+	if sc.Err() != nil {
+		f.remove(c)
+	}
+}
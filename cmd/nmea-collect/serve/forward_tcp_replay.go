@@ -0,0 +1,139 @@
+package serve
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/exp/slices"
+)
+
+var (
+	tcpReplayEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nmea",
+		Subsystem: "tcp",
+		Name:      "replay_entries",
+	}, []string{"source"})
+	tcpReplayedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nmea",
+		Subsystem: "tcp",
+		Name:      "replayed_messages_total",
+	}, []string{"source"})
+)
+
+// replayCache keeps the last sentence of each talker and type, and for
+// AIS of each MMSI and message type, so that new clients can be brought
+// up to date without waiting for slow sentences such as AIS static data.
+// Multi-sentence AIS messages and sentence groups such as GSV are kept
+// whole. Sentences from TCP clients and our own CPA alarms aren't kept.
+type replayCache struct {
+	source string
+	maxAge time.Duration
+
+	mut     sync.Mutex
+	entries map[string]*replayEntry // key as for decimation
+	pending map[string]*replayEntry // multi-sentence messages being received
+	swept   time.Time
+}
+
+type replayEntry struct {
+	lines []string
+	when  time.Time
+}
+
+// newReplayCache returns a cache for entries up to maxAge old, or nil,
+// caching nothing, if maxAge isn't positive. The source labels the
+// cache's metrics.
+func newReplayCache(source string, maxAge time.Duration) *replayCache {
+	if maxAge <= 0 {
+		return nil
+	}
+	tcpReplayEntries.WithLabelValues(source)
+	tcpReplayedMessages.WithLabelValues(source)
+	return &replayCache{
+		source:  source,
+		maxAge:  maxAge,
+		entries: make(map[string]*replayEntry),
+		pending: make(map[string]*replayEntry),
+	}
+}
+
+// add records the line as the latest for the message.
+func (c *replayCache) add(msg *Message, line string) {
+	if c == nil {
+		return
+	}
+	if msg.origin != nil || msg.Source == cpaSource {
+		// These are about the moment they're sent; replayed later they
+		// could steer an autopilot or raise an alarm that was cleared.
+		return
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	key, fragment, last := decimateKey(msg)
+	switch {
+	case fragment <= 1 && last:
+		c.entries[key] = &replayEntry{lines: []string{line}, when: msg.Received}
+	case fragment == 1:
+		c.pending[key] = &replayEntry{lines: []string{line}, when: msg.Received}
+	default:
+		e, ok := c.pending[key]
+		if !ok {
+			// We missed the start of the message.
+			return
+		}
+		e.lines = append(e.lines, line)
+		if last {
+			delete(c.pending, key)
+			c.entries[key] = e
+		}
+	}
+
+	c.sweep(msg.Received)
+}
+
+// sweep forgets expired entries.
+func (c *replayCache) sweep(now time.Time) {
+	if now.Sub(c.swept) < time.Minute {
+		return
+	}
+	c.swept = now
+	for _, m := range []map[string]*replayEntry{c.entries, c.pending} {
+		for key, e := range m {
+			if now.Sub(e.when) > c.maxAge {
+				delete(m, key)
+			}
+		}
+	}
+	tcpReplayEntries.WithLabelValues(c.source).Set(float64(len(c.entries)))
+}
+
+// snapshot returns the lines of all current entries, in the order they
+// were received.
+func (c *replayCache) snapshot(now time.Time) []string {
+	if c == nil {
+		return nil
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	entries := make([]*replayEntry, 0, len(c.entries))
+	for _, e := range c.entries {
+		if now.Sub(e.when) <= c.maxAge {
+			entries = append(entries, e)
+		}
+	}
+	slices.SortFunc(entries, func(a, b *replayEntry) bool {
+		return a.when.Before(b.when)
+	})
+
+	var lines []string
+	for _, e := range entries {
+		lines = append(lines, e.lines...)
+	}
+	tcpReplayEntries.WithLabelValues(c.source).Set(float64(len(c.entries)))
+	tcpReplayedMessages.WithLabelValues(c.source).Add(float64(len(lines)))
+	return lines
+}
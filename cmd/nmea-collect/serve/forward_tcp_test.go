@@ -0,0 +1,259 @@
+package serve
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPForwarderSlowClient(t *testing.T) {
+	f := &tcpForwarder{
+		addr:    "test",
+		clients: make(map[*tcpClient]struct{}),
+	}
+
+	// A client that never reads
+	slow, slowPeer := net.Pipe()
+	defer slowPeer.Close()
+	f.addConn(slow)
+
+	// A client that reads everything
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	fastPeer, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fastPeer.Close()
+	fast, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.addConn(fast)
+
+	br := bufio.NewReader(fastPeer)
+	t0 := time.Now()
+	for i := 0; i < 2*tcpClientQueueSize; i++ {
+		f.send("$GPGSV,1,1,00*79", nil, t0)
+		if _, err := br.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f.mut.Lock()
+	n := len(f.clients)
+	f.mut.Unlock()
+	if n != 2 {
+		t.Fatalf("expected both clients still connected, got %d", n)
+	}
+
+	// Once the slow client has been behind for long enough it's
+	// disconnected, while the fast one keeps receiving.
+	f.send("$GPGSV,1,1,00*79", nil, t0.Add(tcpClientMaxLag+time.Second))
+	if _, err := br.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+
+	f.mut.Lock()
+	n = len(f.clients)
+	f.mut.Unlock()
+	if n != 1 {
+		t.Fatalf("expected the slow client to be disconnected, got %d clients", n)
+	}
+
+	// The slow peer sees the one line the writer had in flight, if any,
+	// and then the close.
+	_ = slowPeer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, slowPeer); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTCPForwarderInject(t *testing.T) {
+	input := make(chan *Message, 10)
+	tee := NewTee("test", nil)
+	autopilot := tee.Output("autopilot", teeDropNewest, 10)
+
+	const (
+		rmb = "$GPRMB,A,0.66,L,003,004,4917.24,N,12309.57,W,001.3,052.5,000.5,V*20"
+		gga = "$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*47"
+		bad = "$GPRMB,A,0.66,L,003,004,4917.24,N,12309.57,W,001.3,052.5,000.5,V*21"
+	)
+
+	cases := []struct {
+		output string
+		c      <-chan *Message
+	}{
+		{"", input},
+		{"autopilot", autopilot},
+	}
+	for _, tc := range cases {
+		inject, err := newTCPInjector([]string{"RMB", "APB"}, input, tee, tc.output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := &tcpForwarder{
+			addr:    "test",
+			inject:  inject,
+			clients: make(map[*tcpClient]struct{}),
+		}
+		conn, peer := net.Pipe()
+		f.addConn(conn)
+
+		// Only the valid sentence of an allowed type gets through.
+		go func() {
+			_, _ = io.WriteString(peer, gga+"\r\n"+bad+"\r\n"+rmb+"\r\n")
+		}()
+		select {
+		case msg := <-tc.c:
+			if msg.Raw != rmb {
+				t.Errorf("got %q, expected %q", msg.Raw, rmb)
+			}
+			if msg.Source != "tcp-forward/test/pipe" {
+				t.Errorf("unexpected source %q", msg.Source)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for injected sentence")
+		}
+		if len(input)+len(autopilot) != 0 {
+			t.Error("unexpected extra sentences")
+		}
+
+		peer.Close()
+		f.mut.Lock()
+		for c := range f.clients {
+			f.removeLocked(c)
+		}
+		f.mut.Unlock()
+	}
+
+	if _, err := newTCPInjector([]string{"RMB,APB"}, nil, nil, ""); err == nil {
+		t.Error("expected error for bad type")
+	}
+	if _, err := newTCPInjector(nil, nil, nil, "autopilot"); err == nil {
+		t.Error("expected error for output without types")
+	}
+}
+
+func TestTCPForwarderNoEcho(t *testing.T) {
+	f := &tcpForwarder{
+		addr:    "test",
+		clients: make(map[*tcpClient]struct{}),
+	}
+	sender, senderPeer := net.Pipe()
+	defer senderPeer.Close()
+	f.addConn(sender)
+	other, otherPeer := net.Pipe()
+	defer otherPeer.Close()
+	f.addConn(other)
+
+	var origin *tcpClient
+	f.mut.Lock()
+	for c := range f.clients {
+		if c.conn == sender {
+			origin = c
+		}
+	}
+	f.mut.Unlock()
+
+	// A sentence from one client goes to the others, but not back.
+	const rmb = "$GPRMB,A,0.66,L,003,004,4917.24,N,12309.57,W,001.3,052.5,000.5,V*20"
+	f.send(rmb, origin, time.Now())
+	if line, err := bufio.NewReader(otherPeer).ReadString('\n'); err != nil || line != rmb+"\n" {
+		t.Errorf("got %q, %v, expected %q", line, err, rmb)
+	}
+	_ = senderPeer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _ := senderPeer.Read(make([]byte, 1)); n != 0 {
+		t.Error("sentence echoed to its sender")
+	}
+
+	f.mut.Lock()
+	for c := range f.clients {
+		f.removeLocked(c)
+	}
+	f.mut.Unlock()
+}
+
+func TestTCPForwarderReplay(t *testing.T) {
+	t0 := time.Now()
+	const (
+		rmc     = "$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6A"
+		gga1    = "$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*47"
+		gga2    = "$GPGGA,123520,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*4D"
+		pos     = "!AIVDM,1,1,,A,1>M;`h>P00PjFb0PWIh>4?wp0000,0*03"
+		static1 = "!AIVDM,2,1,4,B,55WilF81SCLtcP;;K?9<4r18Dlv20000000000166pA7453V0:21C31,0*5D"
+		static2 = "!AIVDM,2,2,4,B,BjDh000000000000,2*17"
+		gsv1    = "$GPGSV,2,1,08,01,40,083,46,02,17,308,41,12,07,344,39,14,22,228,45*75"
+		gsv2    = "$GPGSV,2,2,08,15,10,100,38,17,05,200,30,19,60,010,44,22,33,150,42*71"
+		gsv1b   = "$GPGSV,2,1,08,01,41,083,46,02,17,308,41,12,07,344,39,14,22,228,45*74"
+		sdrA    = "!AIVDM,1,1,,A,H42O55i18tMET00000000000000,2*6D"
+		sdrB    = "!AIVDM,1,1,,A,H42O55lti4hhhilD3nink000?050,0*40"
+		rmb     = "$GPRMB,A,0.66,L,003,004,4917.24,N,12309.57,W,001.3,052.5,000.5,V*20"
+	)
+
+	a := assembleAIS(nil, nil, time.Minute)
+	a.pending = make(map[aisFragmentKey]*aisFragments)
+	f := &tcpForwarder{
+		addr:    "test",
+		replay:  newReplayCache("test", 10*time.Minute),
+		clients: make(map[*tcpClient]struct{}),
+	}
+	for _, m := range []struct {
+		age  time.Duration
+		line string
+	}{
+		{20 * time.Minute, rmc}, // too old to replay
+		{3 * time.Minute, gga1}, // replaced by the later one
+		{2 * time.Minute, pos},
+		{90 * time.Second, gsv1},
+		{90 * time.Second, gsv2},
+		{time.Minute, static1},
+		{time.Minute, static2},
+		{45 * time.Second, sdrA}, // both parts of type 24 are kept
+		{40 * time.Second, sdrB},
+		{30 * time.Second, gsv1b}, // incomplete, the previous group stays
+		{0, gga2},
+	} {
+		msg := acceptLine("test", m.line)
+		msg.Received = t0.Add(-m.age)
+		a.process(msg)
+		f.replay.add(msg, msg.Line())
+	}
+
+	// Sentences from clients and CPA alarms aren't replayed.
+	injected := acceptLine("test", rmb)
+	injected.origin = &tcpClient{}
+	injected.Received = t0
+	f.replay.add(injected, injected.Line())
+	alarm := acceptLine(cpaSource, alrSentence(t0, 1, true, &cpaResult{MMSI: 123456789}))
+	alarm.Received = t0
+	f.replay.add(alarm, alarm.Line())
+
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	f.addConn(conn)
+	f.send(rmc, nil, t0)
+
+	// The cached sentences come first, oldest first, followed by live data.
+	br := bufio.NewReader(peer)
+	for _, want := range []string{pos, gsv1, gsv2, static1, static2, sdrA, sdrB, gga2, rmc} {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != want+"\n" {
+			t.Errorf("got %q, expected %q", line, want)
+		}
+	}
+
+	f.mut.Lock()
+	for c := range f.clients {
+		f.removeLocked(c)
+	}
+	f.mut.Unlock()
+}
@@ -38,19 +38,23 @@ var (
 )
 
 type udpForwarder struct {
-	c             <-chan string
+	c             <-chan *Message
 	addrs         []string
 	maxPacketSize int
 	maxDelay      time.Duration
+	stripTagBlock bool
+	decimate      *decimator
 	buf           bytes.Buffer
 }
 
-func forwardUDP(c <-chan string, addrs []string, maxPacketSize int, maxDelay time.Duration) *udpForwarder {
+func forwardUDP(c <-chan *Message, addrs []string, maxPacketSize int, maxDelay time.Duration, stripTagBlock bool, decimate *decimator) *udpForwarder {
 	return &udpForwarder{
 		c:             c,
 		addrs:         addrs,
 		maxPacketSize: maxPacketSize,
 		maxDelay:      maxDelay,
+		stripTagBlock: stripTagBlock,
+		decimate:      decimate,
 	}
 }
 
@@ -83,8 +87,15 @@ func (f *udpForwarder) Serve(ctx context.Context) error {
 
 	for {
 		select {
-		case line := <-f.c:
+		case msg := <-f.c:
 			aisReceivedMessages.Inc()
+			if !f.decimate.Pass(msg) {
+				continue
+			}
+			line := msg.Line()
+			if f.stripTagBlock {
+				line = msg.Raw
+			}
 
 			if f.buf.Len()+len(line)+2 > f.maxPacketSize {
 				f.flush(dsts)
@@ -96,6 +107,10 @@ func (f *udpForwarder) Serve(ctx context.Context) error {
 		case <-timer.C:
 			f.flush(dsts)
 			timer.Reset(f.maxDelay)
+
+		case <-ctx.Done():
+			f.flush(dsts)
+			return ctx.Err()
 		}
 	}
 }
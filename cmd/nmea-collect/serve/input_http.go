@@ -0,0 +1,174 @@
+package serve
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const httpInputMaxBodySize = 16 << 20
+
+// httpInput accepts batches of NMEA sentences POSTed as plain text (one
+// sentence per line), NDJSON (one JSON string per line) or a JSON array
+// of strings. Each request is answered with the number of accepted and
+// rejected lines.
+type httpInput struct {
+	addr  string
+	token string
+	lines chan<- *Message
+}
+
+type httpInputResult struct {
+	Accepted int `json:"accepted"`
+	Rejected int `json:"rejected"`
+}
+
+func readHTTPInto(c chan<- *Message, port int, token string) *httpInput {
+	return &httpInput{
+		addr:  fmt.Sprintf(":%d", port),
+		token: token,
+		lines: c,
+	}
+}
+
+func (h *httpInput) String() string {
+	return fmt.Sprintf("http-input(%s)@%p", h.addr, h)
+}
+
+func (h *httpInput) Serve(ctx context.Context) error {
+	l, err := net.Listen("tcp", h.addr)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: 15 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- srv.Serve(l)
+	}()
+
+	select {
+	case err := <-errC:
+		return err
+	case <-ctx.Done():
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(sctx)
+		return ctx.Err()
+	}
+}
+
+func (h *httpInput) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	source := h.source(r)
+	registerInputMetrics(source)
+
+	lines, err := readHTTPLines(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var res httpInputResult
+	for _, line := range lines {
+		msg := acceptLine(source, strings.TrimRight(line, "\r\n"))
+		if msg == nil {
+			res.Rejected++
+			continue
+		}
+		select {
+		case h.lines <- msg:
+			res.Accepted++
+		case <-r.Context().Done():
+			// We're shutting down, or the client went away.
+			http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+func (h *httpInput) authorized(r *http.Request) bool {
+	if h.token == "" {
+		return true
+	}
+	auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(auth), []byte(h.token)) == 1
+}
+
+// source returns the metrics source name for the request, being the
+// client address.
+func (h *httpInput) source(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return fmt.Sprintf("http/%s/%s", h.addr, host)
+}
+
+// readHTTPLines returns the lines in the request body, decoded according
+// to the request content type.
+func readHTTPLines(w http.ResponseWriter, r *http.Request) ([]string, error) {
+	body := http.MaxBytesReader(w, r.Body, httpInputMaxBodySize)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	switch mediaType {
+	case "application/json":
+		var lines []string
+		if err := json.NewDecoder(body).Decode(&lines); err != nil {
+			return nil, fmt.Errorf("decoding JSON array: %w", err)
+		}
+		return lines, nil
+
+	case "application/x-ndjson", "application/jsonl":
+		var lines []string
+		dec := json.NewDecoder(body)
+		for {
+			var line string
+			if err := dec.Decode(&line); errors.Is(err, io.EOF) {
+				return lines, nil
+			} else if err != nil {
+				return nil, fmt.Errorf("decoding NDJSON: %w", err)
+			}
+			lines = append(lines, line)
+		}
+
+	default:
+		var lines []string
+		sc := bufio.NewScanner(body)
+		sc.Buffer(make([]byte, 0, 65536), 65536)
+		for sc.Scan() {
+			lines = append(lines, sc.Text())
+		}
+		if err := sc.Err(); err != nil {
+			return nil, fmt.Errorf("reading body: %w", err)
+		}
+		return lines, nil
+	}
+}
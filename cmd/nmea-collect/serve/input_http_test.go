@@ -0,0 +1,73 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPInput(t *testing.T) {
+	cases := []struct {
+		contentType string
+		body        string
+		want        httpInputResult
+	}{
+		{"text/plain", "$YDHDG,58.8,0.0,E,4.3,E*66\r\n$YDDPT,2.45,0.00*5F\r\n", httpInputResult{Accepted: 1, Rejected: 1}},
+		{"application/json", `["$YDHDG,58.8,0.0,E,4.3,E*66", "$YDDPT,2.45,0.00*5E"]`, httpInputResult{Accepted: 2}},
+		{"application/x-ndjson", "\"$YDHDG,58.8,0.0,E,4.3,E*66\"\n\"garbage\"\n", httpInputResult{Accepted: 1, Rejected: 1}},
+	}
+
+	for _, c := range cases {
+		lines := make(chan *Message, 10)
+		h := readHTTPInto(lines, 8080, "secret")
+
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(c.body))
+		req.Header.Set("Content-Type", c.contentType)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d", c.contentType, rec.Code)
+		}
+		var res httpInputResult
+		if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if res != c.want {
+			t.Errorf("%s: got %+v, want %+v", c.contentType, res, c.want)
+		}
+		if len(lines) != c.want.Accepted {
+			t.Errorf("%s: got %d lines, want %d", c.contentType, len(lines), c.want.Accepted)
+		}
+	}
+}
+
+func TestHTTPInputUnauthorized(t *testing.T) {
+	h := readHTTPInto(make(chan *Message, 1), 8080, "secret")
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("$YDHDG,58.8,0.0,E,4.3,E*66\n"))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("unexpected status %d", rec.Code)
+	}
+}
+
+func TestHTTPInputCancelled(t *testing.T) {
+	// Nobody reads the lines, and the request is cancelled.
+	h := readHTTPInto(make(chan *Message), 8080, "")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodPost, "/?source=spoofed", strings.NewReader("$YDHDG,58.8,0.0,E,4.3,E*66\n")).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status %d", rec.Code)
+	}
+	if src := h.source(req); src != "http/:8080/192.0.2.1" {
+		t.Errorf("unexpected source %q", src)
+	}
+}
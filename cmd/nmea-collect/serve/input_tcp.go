@@ -0,0 +1,116 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/exp/slog"
+)
+
+var (
+	tcpInputIncomingConnections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nmea",
+		Subsystem: "tcp_input",
+		Name:      "incoming_connections_total",
+	}, []string{"source"})
+	tcpInputCurrentConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nmea",
+		Subsystem: "tcp_input",
+		Name:      "current_connections",
+	}, []string{"source"})
+)
+
+// tcpInputReadTimeout is how long a sender may be silent before we
+// consider the connection dead and close it.
+const tcpInputReadTimeout = time.Minute
+
+// tcpInputListener accepts incoming connections from senders pushing
+// NMEA, reading each connection as a separate source.
+type tcpInputListener struct {
+	addr  string
+	lines chan<- *Message
+}
+
+func listenTCPInto(c chan<- *Message, addr string) *tcpInputListener {
+	return &tcpInputListener{
+		addr:  addr,
+		lines: c,
+	}
+}
+
+func (t *tcpInputListener) String() string {
+	return fmt.Sprintf("tcp-input-listener(%s)@%p", t.addr, t)
+}
+
+func (t *tcpInputListener) Serve(ctx context.Context) error {
+	l, err := net.Listen("tcp", t.addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	// Stop the connections before waiting for them, whatever the reason
+	// we return.
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	go func() {
+		<-ctx.Done()
+		_ = l.Close()
+	}()
+
+	tcpInputIncomingConnections.WithLabelValues(t.addr)
+	tcpInputCurrentConnections.WithLabelValues(t.addr)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		tcpInputIncomingConnections.WithLabelValues(t.addr).Inc()
+		tcpInputCurrentConnections.WithLabelValues(t.addr).Inc()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer tcpInputCurrentConnections.WithLabelValues(t.addr).Dec()
+			t.handle(ctx, conn)
+		}()
+	}
+}
+
+func (t *tcpInputListener) handle(ctx context.Context, conn net.Conn) {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		host = conn.RemoteAddr().String()
+	}
+	source := fmt.Sprintf("tcp-listen/%s/%s", t.addr, host)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+
+	l := slog.Default().With("source", source)
+	l.Info("Accepted input connection", "remote", conn.RemoteAddr())
+	lw := linesInto(t.lines, conn, source)
+	lw.readTimeout = tcpInputReadTimeout
+	err = lw.Serve(ctx)
+	l.Info("Input connection closed", "remote", conn.RemoteAddr(), "error", err)
+}
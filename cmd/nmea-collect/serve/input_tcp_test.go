@@ -0,0 +1,65 @@
+package serve
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPInputListener(t *testing.T) {
+	// Find a free port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	c := make(chan *Message, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- listenTCPInto(c, addr).Serve(ctx) }()
+
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	const gga = "$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*47"
+	if _, err := io.WriteString(conn, gga+"\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-c:
+		if msg.Raw != gga {
+			t.Errorf("got %q, expected %q", msg.Raw, gga)
+		}
+		if msg.Source != "tcp-listen/"+addr+"/127.0.0.1" {
+			t.Errorf("unexpected source %q", msg.Source)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for sentence")
+	}
+
+	// Stopping the listener closes the still open connection and returns.
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener did not stop")
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the connection to be closed, got %v", err)
+	}
+}
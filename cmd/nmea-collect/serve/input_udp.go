@@ -0,0 +1,136 @@
+package serve
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// udpInput receives NMEA datagrams on a unicast, broadcast or multicast
+// address, optionally bound to a given network interface. Lines are
+// accounted per sender.
+type udpInput struct {
+	spec        string
+	addr        *net.UDPAddr
+	iface       string
+	lines       chan<- *Message
+	readTimeout time.Duration
+	senders     map[string]string
+}
+
+// readUDPInto returns an input for the given listen specification, which
+// is on the form "port", "addr:port" or "group:port", optionally followed
+// by "@iface". IPv6 addresses are given in brackets, e.g. "[::]:2000" or
+// "[ff02::1]:2000@eth0".
+func readUDPInto(c chan<- *Message, spec string) (*udpInput, error) {
+	addr, iface, _ := strings.Cut(spec, "@")
+	if addr == "" {
+		return nil, fmt.Errorf("udp %q: missing address or port", spec)
+	}
+	if _, err := strconv.Atoi(addr); err == nil {
+		addr = ":" + addr
+	}
+	uaddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("udp %q: %w", spec, err)
+	}
+	return &udpInput{
+		spec:        spec,
+		addr:        uaddr,
+		iface:       iface,
+		lines:       c,
+		readTimeout: 15 * time.Second,
+	}, nil
+}
+
+func (u *udpInput) String() string {
+	return fmt.Sprintf("udp-input(%s)@%p", u.spec, u)
+}
+
+func (u *udpInput) Serve(ctx context.Context) error {
+	conn, err := u.listen(ctx)
+	if err != nil {
+		return fmt.Errorf("reader: %w", err)
+	}
+	defer conn.Close()
+
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	u.senders = make(map[string]string)
+	buf := make([]byte, 65536)
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(u.readTimeout)); err != nil {
+			return err
+		}
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		source := u.source(from)
+		sc := bufio.NewScanner(bytes.NewReader(buf[:n]))
+		for sc.Scan() {
+			msg := acceptLine(source, sc.Text())
+			if msg == nil {
+				continue
+			}
+			select {
+			case u.lines <- msg:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+func (u *udpInput) listen(ctx context.Context) (*net.UDPConn, error) {
+	if u.addr.IP.IsMulticast() {
+		var ifi *net.Interface
+		if u.iface != "" {
+			var err error
+			ifi, err = net.InterfaceByName(u.iface)
+			if err != nil {
+				return nil, err
+			}
+		}
+		network := "udp6"
+		if u.addr.IP.To4() != nil {
+			network = "udp4"
+		}
+		return net.ListenMulticastUDP(network, ifi, u.addr)
+	}
+
+	var lc net.ListenConfig
+	if u.iface != "" {
+		lc.Control = bindToDeviceControl(u.iface)
+	}
+	conn, err := lc.ListenPacket(ctx, "udp", u.addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// source returns the metrics source name for the given sender, registering
+// the metrics on first sight.
+func (u *udpInput) source(from *net.UDPAddr) string {
+	ip := from.IP.String()
+	source, ok := u.senders[ip]
+	if !ok {
+		source = fmt.Sprintf("udp/%s/%s", u.spec, ip)
+		registerInputMetrics(source)
+		u.senders[ip] = source
+	}
+	return source
+}
@@ -0,0 +1,82 @@
+package serve
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestUDPInputMulticast(t *testing.T) {
+	lo := loopbackInterface(t)
+	c := make(chan *Message, 1)
+	u, err := readUDPInto(c, "239.192.0.1:0@"+lo.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := u.listen(context.Background())
+	if err != nil {
+		t.Skip("can't join multicast group:", err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+
+	// Listen for real on the port we got, and send to the group.
+	u, err = readUDPInto(c, "239.192.0.1:"+strconv.Itoa(port)+"@"+lo.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = u.Serve(ctx) }()
+
+	dst := &net.UDPAddr{IP: net.IPv4(239, 192, 0, 1), Port: port}
+	send, err := net.DialUDP("udp4", nil, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer send.Close()
+	rc, err := send.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = rc.Control(func(fd uintptr) {
+		_ = unix.SetsockoptInet4Addr(int(fd), unix.IPPROTO_IP, unix.IP_MULTICAST_IF, [4]byte{127, 0, 0, 1})
+	})
+
+	const gga = "$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*47"
+	deadline := time.After(2 * time.Second)
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		// Resend until the listener has joined the group.
+		_, _ = send.Write([]byte(gga + "\r\n"))
+		select {
+		case msg := <-c:
+			if msg.Raw != gga {
+				t.Errorf("got %q, expected %q", msg.Raw, gga)
+			}
+			return
+		case <-tick.C:
+		case <-deadline:
+			t.Skip("no multicast delivery on the loopback interface")
+		}
+	}
+}
+
+func loopbackInterface(t *testing.T) *net.Interface {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		t.Skip(err)
+	}
+	for i := range ifs {
+		if ifs[i].Flags&net.FlagLoopback != 0 && ifs[i].Flags&net.FlagUp != 0 && ifs[i].Flags&net.FlagMulticast != 0 {
+			return &ifs[i]
+		}
+	}
+	t.Skip("no multicast capable loopback interface")
+	return nil
+}
@@ -0,0 +1,37 @@
+package serve
+
+import (
+	"testing"
+)
+
+func TestReadUDPIntoSpec(t *testing.T) {
+	cases := []struct {
+		in    string
+		addr  string
+		iface string
+	}{
+		{"2000", ":2000", ""},
+		{"127.0.0.1:2000", "127.0.0.1:2000", ""},
+		{"239.192.0.1:2000@eth0", "239.192.0.1:2000", "eth0"},
+		{"[::]:2000", "[::]:2000", ""},
+		{"[ff02::1]:2000@eth0", "[ff02::1]:2000", "eth0"},
+		{"2000@eth1", ":2000", "eth1"},
+	}
+	for _, c := range cases {
+		u, err := readUDPInto(nil, c.in)
+		if err != nil {
+			t.Errorf("readUDPInto(%q): %v", c.in, err)
+			continue
+		}
+		if u.addr.String() != c.addr || u.iface != c.iface {
+			t.Errorf("readUDPInto(%q) == %s@%s, want %s@%s", c.in, u.addr, u.iface, c.addr, c.iface)
+		}
+	}
+
+	bad := []string{"", "@eth0", "host.invalid:2000", "127.0.0.1:notaport", "[::1:2000"}
+	for _, in := range bad {
+		if _, err := readUDPInto(nil, in); err == nil {
+			t.Errorf("readUDPInto(%q) should fail", in)
+		}
+	}
+}
@@ -97,9 +97,10 @@ var (
 )
 
 type instrumentsCollector struct {
-	c      <-chan string
-	exts   writer.Extensions
-	extMut sync.Mutex
+	c         <-chan *Message
+	positions <-chan ownShipFix
+	exts      writer.Extensions
+	extMut    sync.Mutex
 }
 
 func (l *instrumentsCollector) String() string {
@@ -125,8 +126,8 @@ func (l *instrumentsCollector) Serve(ctx context.Context) error {
 
 	for {
 		select {
-		case line := <-l.c:
-			sent, err := nmea.Parse(line)
+		case msg := <-l.c:
+			sent, err := msg.Sentence()
 			if err != nil {
 				continue
 			}
@@ -185,18 +186,6 @@ func (l *instrumentsCollector) Serve(ctx context.Context) error {
 				l.exts.Set("waterspeed", fmt.Sprintf("%.01f", vhw.SpeedThroughWaterKnots))
 				l.extMut.Unlock()
 
-			case nmea.TypeGLL:
-				gll := sent.(nmea.GLL)
-				if gll.Validity == "A" {
-					position.WithLabelValues("lat").Set(gll.Latitude)
-					position.WithLabelValues("lon").Set(gll.Longitude)
-					if !positionRegistered {
-						prometheus.Register(position)
-						positionRegistered = true
-					}
-					positionTimeout.Reset(instrumentRetention)
-				}
-
 			case nmea.TypeXDR:
 				xdr := sent.(nmea.XDR)
 				for _, m := range xdr.Measurements {
@@ -230,6 +219,15 @@ func (l *instrumentsCollector) Serve(ctx context.Context) error {
 				}
 			}
 
+		case fix := <-l.positions:
+			position.WithLabelValues("lat").Set(fix.Lat)
+			position.WithLabelValues("lon").Set(fix.Lon)
+			if !positionRegistered {
+				prometheus.Register(position)
+				positionRegistered = true
+			}
+			positionTimeout.Reset(instrumentRetention)
+
 		case <-positionTimeout.C:
 			if positionRegistered {
 				prometheus.Unregister(position)
@@ -253,7 +251,8 @@ func (i *instrumentsCollector) GPXExtensions() writer.Extensions {
 }
 
 type prometheusListener struct {
-	addr string
+	addr     string
+	handlers map[string]http.HandlerFunc
 }
 
 func (l *prometheusListener) String() string {
@@ -263,6 +262,9 @@ func (l *prometheusListener) String() string {
 func (l *prometheusListener) Serve(ctx context.Context) error {
 	mux := http.NewServeMux()
 	mux.Handle("/", promhttp.Handler())
+	for path, handler := range l.handlers {
+		mux.HandleFunc(path, handler)
+	}
 
 	list, err := net.Listen("tcp", l.addr)
 	if err != nil {
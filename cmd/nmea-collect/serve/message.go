@@ -0,0 +1,121 @@
+package serve
+
+import (
+	"sync"
+	"time"
+
+	"github.com/BertoldVdb/go-ais"
+	nmea "github.com/adrianmo/go-nmea"
+)
+
+// aisCodec is shared by all messages; decoding doesn't modify it.
+var aisCodec = ais.CodecNew(false, false)
+
+// Message is a sentence passing through the pipeline, together with where
+// and when it was received. Messages are shared between all consumers
+// once they leave the input and must not be modified.
+type Message struct {
+	Raw      string    // the sentence, without any tag block
+	Source   string    // the input the message was read from
+	Received time.Time // when the message was read
+	TagBlock *tagBlock // the tag block, if the sentence had one
+
+	rawTagBlock string // the tag block as received, including backslashes
+	origin      any    // the connection the message came from, if it must not be echoed there
+
+	parseOnce sync.Once
+	sentence  nmea.Sentence
+	parseErr  error
+
+	aisPayload []byte      // assembled payload of a multi-sentence message
+	aisHeader  *ais.Header // header of a multi-sentence message, on all its sentences
+	aisOnce    sync.Once
+	aisPacket  ais.Packet
+}
+
+// Line returns the message as received, including any tag block.
+func (m *Message) Line() string {
+	return m.rawTagBlock + m.Raw
+}
+
+func (m *Message) String() string {
+	return m.Line()
+}
+
+// Time returns the receive time from the tag block if there is one, or
+// otherwise the time we received the message. It's for recording; as the
+// tag block time may be skewed or from replayed data, anything comparing
+// with the current time, such as expiry, should use Received.
+func (m *Message) Time() time.Time {
+	if m.TagBlock != nil && !m.TagBlock.Time.IsZero() {
+		return m.TagBlock.Time
+	}
+	return m.Received
+}
+
+// OwnVessel returns true for VDO sentences, which describe our own vessel
+// rather than a received target.
+func (m *Message) OwnVessel() bool {
+	return len(m.Raw) > 6 && m.Raw[3:6] == "VDO"
+}
+
+// Sentence returns the parsed sentence. Parsing happens on first use and
+// the result is shared by all later callers.
+func (m *Message) Sentence() (nmea.Sentence, error) {
+	m.parseOnce.Do(func() {
+		m.sentence, m.parseErr = nmea.Parse(m.Raw)
+	})
+	return m.sentence, m.parseErr
+}
+
+// AIS returns the decoded AIS packet for VDM and VDO sentences, or nil if
+// the message isn't AIS or can't be decoded. For multi-sentence messages
+// the packet is available on the last sentence, once assembled. Like the
+// sentence, the packet is decoded on first use and then shared.
+func (m *Message) AIS() ais.Packet {
+	m.aisOnce.Do(func() {
+		if m.aisPayload != nil {
+			m.aisPacket = aisCodec.DecodePacket(m.aisPayload)
+			return
+		}
+		sent, err := m.Sentence()
+		if err != nil {
+			return
+		}
+		vdmvdo, ok := sent.(nmea.VDMVDO)
+		if !ok || vdmvdo.NumFragments > 1 {
+			return
+		}
+		m.aisPacket = aisCodec.DecodePacket(vdmvdo.Payload)
+	})
+	return m.aisPacket
+}
+
+// AISHeader returns the message type and MMSI of an AIS message. Unlike
+// AIS, this is also available on every sentence of a multi-sentence
+// message, from the first sentence onwards.
+func (m *Message) AISHeader() (ais.Header, bool) {
+	if m.aisHeader != nil {
+		return *m.aisHeader, true
+	}
+	if pkt := m.AIS(); pkt != nil {
+		return *pkt.GetHeader(), true
+	}
+	return ais.Header{}, false
+}
+
+// aisPayloadHeader returns the header from the start of an AIS payload, as
+// bits.
+func aisPayloadHeader(bits []byte) (ais.Header, bool) {
+	if len(bits) < 38 {
+		return ais.Header{}, false
+	}
+	var hdr ais.Header
+	for _, b := range bits[:6] {
+		hdr.MessageID = hdr.MessageID<<1 | b
+	}
+	for _, b := range bits[8:38] {
+		hdr.UserID = hdr.UserID<<1 | uint32(b)
+	}
+	return hdr, true
+}
@@ -0,0 +1,144 @@
+package serve
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"calmh.dev/nmea-collect/internal/aisregistry"
+	nmea "github.com/adrianmo/go-nmea"
+	"golang.org/x/exp/slog"
+)
+
+func TestMessageSharedParse(t *testing.T) {
+	msg := acceptLine("test", "!AIVDM,1,1,,A,18;Or00w1mPrD:dO`=bD@3LN08;b,0*2E")
+	if msg == nil {
+		t.Fatal("line should be accepted")
+	}
+	s1, err := msg.Sentence()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, _ := msg.Sentence()
+	if s1.(nmea.VDMVDO).Raw != s2.(nmea.VDMVDO).Raw {
+		t.Error("sentence should be cached")
+	}
+	pkt := msg.AIS()
+	if pkt == nil {
+		t.Fatal("should decode AIS")
+	}
+	if id := pkt.GetHeader().MessageID; id != 1 {
+		t.Error("bad message ID", id)
+	}
+}
+
+// BenchmarkMainTee sends messages through the main tee to the consumers
+// that look at parsed sentences, wired up as in serve. With "shared" they
+// all get the same message and parse it once between them; with "copies"
+// each gets a copy of its own to parse, as before messages were shared.
+func BenchmarkMainTee(b *testing.B) {
+	b.Run("shared", func(b *testing.B) { benchmarkMainTee(b, false) })
+	b.Run("copies", func(b *testing.B) { benchmarkMainTee(b, true) })
+}
+
+func benchmarkMainTee(b *testing.B, copies bool) {
+	lines := readTestLines(b, "testdata/raw2")
+	reg, err := aisregistry.Open(filepath.Join(b.TempDir(), "registry.json"))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var running sync.WaitGroup
+	defer running.Wait()
+	defer cancel()
+
+	input := make(chan *Message)
+	tee := NewTee("main", input)
+
+	// Each consumer reads through a relay, which marks the message as
+	// handed over so that we know when all of them are done.
+	var delivered sync.WaitGroup
+	consumers := 0
+	output := func(name string) <-chan *Message {
+		consumers++
+		in := tee.Output(name, teeBlock, 0)
+		out := make(chan *Message)
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			for {
+				select {
+				case msg := <-in:
+					if copies {
+						msg = &Message{Raw: msg.Raw, Source: msg.Source, Received: msg.Received, TagBlock: msg.TagBlock, rawTagBlock: msg.rawTagBlock}
+					}
+					select {
+					case out <- msg:
+						delivered.Done()
+					case <-ctx.Done():
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return out
+	}
+
+	own := newOwnShip(output("own-ship"), positionSources, time.Minute, 0)
+	targets := newAISTargets(output("ais-targets"), time.Hour)
+	for _, svc := range []interface{ Serve(context.Context) error }{
+		tee,
+		own,
+		&instrumentsCollector{c: output("instruments"), positions: own.Output()},
+		newAISContactsCounter(output("ais-contacts"), []time.Duration{5 * time.Minute}),
+		targets,
+		monitorAISAlerts(output("ais-alerts"), targets, "", "", "", time.Hour),
+		newAISCoverage(output("ais-coverage"), own),
+		recordAISRegistry(output("ais-registry"), own, reg, time.Hour),
+		collectAISTracks(output("ais-tracks"), slog.Default(), "", []uint32{1}, nil),
+	} {
+		svc := svc
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			_ = svc.Serve(ctx)
+		}()
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, line := range lines {
+			msg := acceptLine("bench", line)
+			if msg == nil {
+				continue
+			}
+			delivered.Add(consumers)
+			input <- msg
+		}
+	}
+	delivered.Wait()
+}
+
+func readTestLines(tb testing.TB, name string) []string {
+	fd, err := os.Open(name)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer fd.Close()
+	var lines []string
+	sc := bufio.NewScanner(fd)
+	for sc.Scan() {
+		if checksumOK(sc.Text()) {
+			lines = append(lines, sc.Text())
+		}
+	}
+	return lines
+}
@@ -6,8 +6,6 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"net/http"
-	"os"
 	"strings"
 	"time"
 
@@ -16,8 +14,6 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
-const teeBufferSize = 4096
-
 var (
 	nmeaMessagesInput = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "nmea",
@@ -44,29 +40,14 @@ var (
 		Subsystem: "input",
 		Name:      "messages_non_nmea_total",
 	}, []string{"source"})
-	nmeaMessagesTeeRead = promauto.NewCounterVec(prometheus.CounterOpts{
-		Namespace: "nmea",
-		Subsystem: "tee",
-		Name:      "messages_input_total",
-	}, []string{"tee"})
-	nmeaMessagesTeeSent = promauto.NewCounterVec(prometheus.CounterOpts{
-		Namespace: "nmea",
-		Subsystem: "tee",
-		Name:      "messages_output_total",
-	}, []string{"tee"})
-	nmeaMessagesTeeFilterSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
-		Namespace: "nmea",
-		Subsystem: "tee",
-		Name:      "messages_filter_skipped_total",
-	}, []string{"tee"})
-	nmeaMessagesTeeDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+	nmeaMessagesBadTagBlock = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "nmea",
-		Subsystem: "tee",
-		Name:      "messages_dropped_total",
-	}, []string{"tee"})
+		Subsystem: "input",
+		Name:      "messages_bad_tag_block_total",
+	}, []string{"source"})
 )
 
-func readTCPInto(c chan<- string, addr string) *lineWriter {
+func readTCPInto(c chan<- *Message, addr string) *lineWriter {
 	return &lineWriter{
 		reader:      func() (io.ReadCloser, error) { return tcpReader(addr) },
 		name:        fmt.Sprintf("tcp/%s", addr),
@@ -83,56 +64,10 @@ func tcpReader(addr string) (io.ReadCloser, error) {
 	return conn, nil
 }
 
-func readHTTPInto(c chan<- string, port int) *lineWriter {
+func readSerialInto(c chan<- *Message, cfg serialConfig) *lineWriter {
 	return &lineWriter{
-		reader: func() (io.ReadCloser, error) { return httpReader(port) },
-		name:   fmt.Sprintf("http//:%d", port),
-		lines:  c,
-	}
-}
-
-func httpReader(port int) (io.ReadCloser, error) {
-	rd, wr := io.Pipe()
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		_, err := io.Copy(wr, r.Body)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-	})
-	srv := http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
-		Handler: mux,
-	}
-	go func() {
-		srv.ListenAndServe()
-	}()
-	return rd, nil
-}
-
-func readUDPInto(c chan<- string, port int) *lineWriter {
-	return &lineWriter{
-		reader:      func() (io.ReadCloser, error) { return udpReader(port) },
-		name:        fmt.Sprintf("udp/%d", port),
-		lines:       c,
-		readTimeout: 15 * time.Second,
-	}
-}
-
-func udpReader(port int) (io.ReadCloser, error) {
-	laddr := &net.UDPAddr{Port: port}
-	conn, err := net.ListenUDP("udp", laddr)
-	if err != nil {
-		return nil, fmt.Errorf("reader: %w", err)
-	}
-	return conn, nil
-}
-
-func readSerialInto(c chan<- string, dev string) *lineWriter {
-	return &lineWriter{
-		reader: func() (io.ReadCloser, error) { return os.Open(dev) },
-		name:   dev,
+		reader: func() (io.ReadCloser, error) { return openSerial(cfg) },
+		name:   cfg.dev,
 		lines:  c,
 	}
 }
@@ -140,7 +75,7 @@ func readSerialInto(c chan<- string, dev string) *lineWriter {
 type lineWriter struct {
 	reader      func() (io.ReadCloser, error)
 	name        string
-	lines       chan<- string
+	lines       chan<- *Message
 	readTimeout time.Duration
 }
 
@@ -155,14 +90,21 @@ func (r *lineWriter) Serve(ctx context.Context) error {
 	}
 	defer reader.Close()
 
+	// Unblock the read below when we're stopped.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = reader.Close()
+		case <-stop:
+		}
+	}()
+
 	sc := bufio.NewScanner(reader)
 	sc.Buffer(make([]byte, 0, 65536), 65536)
 
-	nmeaMessagesInput.WithLabelValues(r.name)
-	nmeaMessagesBad.WithLabelValues(r.name)
-	nmeaMessagesEmpty.WithLabelValues(r.name)
-	nmeaMessagesNoChecksum.WithLabelValues(r.name)
-	nmeaMessagesNonNMEA.WithLabelValues(r.name)
+	registerInputMetrics(r.name)
 
 	if err := r.trySetDeadline(reader); err != nil {
 		return err
@@ -179,31 +121,14 @@ func (r *lineWriter) Serve(ctx context.Context) error {
 			return err
 		}
 
-		line := sc.Text()
-		nmeaMessagesInput.WithLabelValues(r.name).Inc()
-		if line == "" {
-			nmeaMessagesEmpty.WithLabelValues(r.name).Inc()
+		msg := acceptLine(r.name, sc.Text())
+		if msg == nil {
 			continue
 		}
-		switch line[0] {
-		case '!', '$':
-			idx := strings.LastIndexByte(line, '*')
-			if idx == -1 {
-				nmeaMessagesNoChecksum.WithLabelValues(r.name).Inc()
-				continue
-			}
-			chk := nmea.Checksum(line[1:idx])
-			if chk != line[idx+1:] {
-				nmeaMessagesBad.WithLabelValues(r.name).Inc()
-				continue
-			}
-			select {
-			case r.lines <- line:
-			case <-ctx.Done():
-				return ctx.Err()
-			}
-		default:
-			nmeaMessagesNonNMEA.WithLabelValues(r.name).Inc()
+		select {
+		case r.lines <- msg:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 
@@ -226,63 +151,77 @@ func (r *lineWriter) trySetDeadline(v any) error {
 	return nil
 }
 
-func linesInto(c chan<- string, r io.ReadCloser, name string) *lineWriter {
-	return &lineWriter{
-		reader: func() (io.ReadCloser, error) { return r, nil },
-		name:   name,
-		lines:  c,
+func registerInputMetrics(source string) {
+	nmeaMessagesInput.WithLabelValues(source)
+	nmeaMessagesBad.WithLabelValues(source)
+	nmeaMessagesEmpty.WithLabelValues(source)
+	nmeaMessagesNoChecksum.WithLabelValues(source)
+	nmeaMessagesNonNMEA.WithLabelValues(source)
+	nmeaMessagesBadTagBlock.WithLabelValues(source)
+}
+
+// acceptLine validates a line read from the given source, accounting for
+// it in the input metrics. It returns the message for a checksummed NMEA
+// sentence, optionally preceded by a valid tag block, or nil if the line
+// should be dropped.
+func acceptLine(source, line string) *Message {
+	nmeaMessagesInput.WithLabelValues(source).Inc()
+	msg := &Message{Raw: line, Source: source, Received: time.Now()}
+	if line == "" {
+		nmeaMessagesEmpty.WithLabelValues(source).Inc()
+		return nil
 	}
-}
-
-type Tee struct {
-	name    string
-	input   <-chan string
-	prefix  string
-	outputs []chan string
-}
-
-func NewTee(name string, input <-chan string) *Tee {
-	return &Tee{name: name, input: input}
-}
-
-func NewFilteredTee(name string, input <-chan string, prefix string) *Tee {
-	return &Tee{name: name, input: input, prefix: prefix}
-}
-
-func (t *Tee) String() string {
-	if t.prefix == "" {
-		return fmt.Sprintf("nmea-tee@%p", t)
+	if line[0] == '\\' {
+		tb, sentence, err := splitTagBlock(line)
+		if err != nil {
+			nmeaMessagesBadTagBlock.WithLabelValues(source).Inc()
+			return nil
+		}
+		msg.Raw = sentence
+		msg.TagBlock = tb
+		msg.rawTagBlock = line[:len(line)-len(sentence)]
+		line = sentence
+		if line == "" {
+			nmeaMessagesEmpty.WithLabelValues(source).Inc()
+			return nil
+		}
+	}
+	switch line[0] {
+	case '!', '$':
+		idx := strings.LastIndexByte(line, '*')
+		if idx == -1 {
+			nmeaMessagesNoChecksum.WithLabelValues(source).Inc()
+			return nil
+		}
+		chk := nmea.Checksum(line[1:idx])
+		if chk != line[idx+1:] {
+			nmeaMessagesBad.WithLabelValues(source).Inc()
+			return nil
+		}
+		return msg
+	default:
+		nmeaMessagesNonNMEA.WithLabelValues(source).Inc()
+		return nil
 	}
-	return fmt.Sprintf("nmea-tee(%q)@%p", t.prefix, t)
 }
 
-func (t *Tee) Output() <-chan string {
-	c := make(chan string, teeBufferSize)
-	t.outputs = append(t.outputs, c)
-	return c
+// checksumOK returns true if the line is an NMEA sentence with a correct
+// checksum.
+func checksumOK(line string) bool {
+	if len(line) == 0 || (line[0] != '!' && line[0] != '$') {
+		return false
+	}
+	idx := strings.LastIndexByte(line, '*')
+	if idx == -1 {
+		return false
+	}
+	return nmea.Checksum(line[1:idx]) == line[idx+1:]
 }
 
-func (t *Tee) Serve(ctx context.Context) error {
-	for {
-		select {
-		case line := <-t.input:
-			nmeaMessagesTeeRead.WithLabelValues(t.name).Inc()
-			if !strings.HasPrefix(line, t.prefix) {
-				nmeaMessagesTeeFilterSkipped.WithLabelValues(t.name).Inc()
-				continue
-			}
-			for _, out := range t.outputs {
-				select {
-				case out <- line:
-					nmeaMessagesTeeSent.WithLabelValues(t.name).Inc()
-				case <-ctx.Done():
-					return ctx.Err()
-				default:
-					nmeaMessagesTeeDropped.WithLabelValues(t.name).Inc()
-				}
-			}
-		case <-ctx.Done():
-			return ctx.Err()
-		}
+func linesInto(c chan<- *Message, r io.ReadCloser, name string) *lineWriter {
+	return &lineWriter{
+		reader: func() (io.ReadCloser, error) { return r, nil },
+		name:   name,
+		lines:  c,
 	}
 }
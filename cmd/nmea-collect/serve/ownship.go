@@ -0,0 +1,293 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"calmh.dev/nmea-collect/internal/geometry"
+	"github.com/BertoldVdb/go-ais"
+	nmea "github.com/adrianmo/go-nmea"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var positionSource = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "nmea",
+	Subsystem: "instruments",
+	Name:      "position_source",
+}, []string{"source"})
+
+// ownShipMaxAge is how old our own position may be and still be used.
+const ownShipMaxAge = time.Minute
+
+// positionSources are the supported sources of our own position.
+var positionSources = []string{"rmc", "gga", "gll", "vdo"}
+
+// ownShipFix is our own position, speed and course at a point in time.
+// The time is when the message was received, and decides how long the fix
+// is current. Stamp is the tag block time if there is one, and UTC is the
+// time given by the GNSS, when known; these are used for recording.
+type ownShipFix struct {
+	Lat    float64   `json:"lat"`
+	Lon    float64   `json:"lon"`
+	SOG    float64   `json:"sog"`
+	COG    float64   `json:"cog"`
+	Time   time.Time `json:"time"`
+	Stamp  time.Time `json:"-"`
+	UTC    time.Time `json:"utc,omitempty"`
+	Source string    `json:"source"`
+}
+
+// SampleTime returns the GNSS time if known, otherwise the tag block or
+// receive time.
+func (f ownShipFix) SampleTime() time.Time {
+	if !f.UTC.IsZero() {
+		return f.UTC
+	}
+	if !f.Stamp.IsZero() {
+		return f.Stamp
+	}
+	return f.Time
+}
+
+// ownShip tracks our own position from the configured sources, in order
+// of priority. A fix from a lower priority source is used only when no
+// higher priority source has given us a fix within the source timeout.
+// It also knows our own MMSI, if configured or seen in a VDO sentence.
+type ownShip struct {
+	c             <-chan *Message
+	sources       []string
+	sourceTimeout time.Duration
+	mmsi          uint32 // configured, or zero
+
+	mut     sync.Mutex
+	fix     ownShipFix
+	vdoMMSI uint32               // from the latest VDO sentence
+	heard   map[string]time.Time // when each source last gave a fix
+	active  string
+	outputs []chan ownShipFix
+}
+
+func newOwnShip(c <-chan *Message, sources []string, sourceTimeout time.Duration, mmsi uint32) *ownShip {
+	return &ownShip{
+		c:             c,
+		sources:       sources,
+		sourceTimeout: sourceTimeout,
+		mmsi:          mmsi,
+		heard:         make(map[string]time.Time),
+	}
+}
+
+func (o *ownShip) String() string {
+	return fmt.Sprintf("own-ship@%p", o)
+}
+
+// Output returns a channel that receives each new fix. Fixes are dropped
+// if the receiver falls more than 64 behind, so that a slow receiver
+// doesn't hold up everyone else using our position. Must be called before
+// Serve.
+func (o *ownShip) Output() <-chan ownShipFix {
+	c := make(chan ownShipFix, 64)
+	o.outputs = append(o.outputs, c)
+	return c
+}
+
+func (o *ownShip) Serve(ctx context.Context) error {
+	o.setActive("")
+
+	staleTicker := time.NewTicker(10 * time.Second)
+	defer staleTicker.Stop()
+
+	for {
+		select {
+		case msg := <-o.c:
+			countGPXInput(msg)
+			if fix, ok := ownShipFixFrom(msg); ok {
+				o.update(fix)
+			}
+			if hdr, ok := msg.AISHeader(); ok && msg.OwnVessel() {
+				o.mut.Lock()
+				o.vdoMMSI = hdr.UserID
+				o.mut.Unlock()
+			}
+
+		case <-staleTicker.C:
+			if _, ok := o.Fix(time.Now()); !ok {
+				o.mut.Lock()
+				o.setActive("")
+				o.mut.Unlock()
+			}
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// update records the fix and makes it the current one, unless a higher
+// priority source is active. It returns true if the fix was used.
+func (o *ownShip) update(fix ownShipFix) bool {
+	o.mut.Lock()
+	defer o.mut.Unlock()
+
+	prio := o.priority(fix.Source)
+	if prio < 0 {
+		return false
+	}
+	o.heard[fix.Source] = fix.Time
+	for _, src := range o.sources[:prio] {
+		if heard, ok := o.heard[src]; ok && fix.Time.Sub(heard) <= o.sourceTimeout {
+			return false
+		}
+	}
+
+	if fix.Source == "gga" || fix.Source == "gll" {
+		// These don't carry speed and course, so we derive them from the
+		// previous fix.
+		prev := o.fix
+		dt := fix.Time.Sub(prev.Time)
+		if !prev.Time.IsZero() && dt >= time.Second && dt <= o.sourceTimeout {
+			fix.SOG = geometry.Distance(prev.Lat, prev.Lon, fix.Lat, fix.Lon) / dt.Hours()
+			fix.COG = geometry.Bearing(prev.Lat, prev.Lon, fix.Lat, fix.Lon)
+		} else {
+			fix.SOG, fix.COG = prev.SOG, prev.COG
+		}
+	}
+
+	o.setActive(fix.Source)
+	o.fix = fix
+	for _, c := range o.outputs {
+		select {
+		case c <- fix:
+		default:
+		}
+	}
+	return true
+}
+
+// setActive updates the metric for the currently used source, if it
+// changed. The caller must hold the lock.
+func (o *ownShip) setActive(source string) {
+	if source == o.active && source != "" {
+		return
+	}
+	o.active = source
+	for _, src := range positionSources {
+		v := 0.0
+		if src == source {
+			v = 1
+		}
+		positionSource.WithLabelValues(src).Set(v)
+	}
+}
+
+func (o *ownShip) priority(source string) int {
+	for i, src := range o.sources {
+		if src == source {
+			return i
+		}
+	}
+	return -1
+}
+
+// Fix returns our latest position, if there is one that isn't older than
+// ownShipMaxAge at the given time.
+func (o *ownShip) Fix(now time.Time) (ownShipFix, bool) {
+	o.mut.Lock()
+	defer o.mut.Unlock()
+	if o.fix.Time.IsZero() || now.Sub(o.fix.Time) > ownShipMaxAge {
+		return ownShipFix{}, false
+	}
+	return o.fix, true
+}
+
+// countGPXInput counts the message in the GPX input metrics, which count
+// the sentences other than AIS, as they did when the GPX track read those
+// directly.
+func countGPXInput(msg *Message) {
+	if !strings.HasPrefix(msg.Raw, "$") {
+		return
+	}
+	gpxInputMessages.Inc()
+	if _, err := msg.Sentence(); err != nil {
+		if strings.Contains(err.Error(), "not supported") {
+			gpxUnsupportedMessages.Inc()
+		} else {
+			gpxBadMessages.Inc()
+		}
+	}
+}
+
+// MMSI returns our own MMSI, as configured or otherwise as seen in VDO
+// sentences, or zero if we don't know it.
+func (o *ownShip) MMSI() uint32 {
+	if o.mmsi != 0 {
+		return o.mmsi
+	}
+	o.mut.Lock()
+	defer o.mut.Unlock()
+	return o.vdoMMSI
+}
+
+// ownShipFixFrom returns the position in the message, if it's one of
+// our own position sources and valid. Positions flagged as void (RMC and
+// GLL status V, GGA without a fix) aren't valid.
+func ownShipFixFrom(msg *Message) (ownShipFix, bool) {
+	if msg.OwnVessel() {
+		fix := ownShipFix{Time: msg.Received, Stamp: msg.Time(), Source: "vdo"}
+		switch p := msg.AIS().(type) {
+		case ais.PositionReport:
+			fix.SOG, fix.COG = float64(p.Sog), float64(p.Cog)
+		case ais.StandardClassBPositionReport:
+			fix.SOG, fix.COG = float64(p.Sog), float64(p.Cog)
+		case ais.ExtendedClassBPositionReport:
+			fix.SOG, fix.COG = float64(p.Sog), float64(p.Cog)
+		default:
+			return ownShipFix{}, false
+		}
+		lat, lon, ok := aisPacketPosition(msg.AIS())
+		if !ok {
+			return ownShipFix{}, false
+		}
+		fix.Lat, fix.Lon = lat, lon
+		if fix.SOG >= 102.3 || fix.COG >= 360 {
+			fix.SOG, fix.COG = 0, 0
+		}
+		return fix, true
+	}
+
+	sent, err := msg.Sentence()
+	if err != nil {
+		return ownShipFix{}, false
+	}
+	var fix ownShipFix
+	switch s := sent.(type) {
+	case nmea.RMC:
+		if s.Validity != "A" {
+			return ownShipFix{}, false
+		}
+		fix = ownShipFix{Lat: s.Latitude, Lon: s.Longitude, SOG: s.Speed, COG: s.Course, Time: msg.Received, Stamp: msg.Time(), Source: "rmc"}
+		if s.Date.Valid && s.Time.Valid {
+			fix.UTC = time.Date(s.Date.YY+2000, time.Month(s.Date.MM), s.Date.DD, s.Time.Hour, s.Time.Minute, s.Time.Second, s.Time.Millisecond*int(time.Millisecond), time.UTC)
+		}
+	case nmea.GGA:
+		if s.FixQuality == nmea.Invalid {
+			return ownShipFix{}, false
+		}
+		fix = ownShipFix{Lat: s.Latitude, Lon: s.Longitude, Time: msg.Received, Stamp: msg.Time(), Source: "gga"}
+	case nmea.GLL:
+		if s.Validity != "A" {
+			return ownShipFix{}, false
+		}
+		fix = ownShipFix{Lat: s.Latitude, Lon: s.Longitude, Time: msg.Received, Stamp: msg.Time(), Source: "gll"}
+	default:
+		return ownShipFix{}, false
+	}
+	if fix.Lat == 0 && fix.Lon == 0 {
+		return ownShipFix{}, false
+	}
+	return fix, true
+}
@@ -0,0 +1,88 @@
+package serve
+
+import (
+	"testing"
+	"time"
+
+	nmea "github.com/adrianmo/go-nmea"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestOwnShipFixFrom(t *testing.T) {
+	vdo := "!AIVDO,1,1,,A,18;Or00w1mPrD:dO`=bD@3LN08;b,0"
+	cases := []struct {
+		line   string
+		source string
+		ok     bool
+	}{
+		{"$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6A", "rmc", true},
+		{"$GPRMC,123519,V,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*7D", "", false},
+		{"$YDGGA,125519.00,5524.8667,N,01255.7953,E,1,10,0.80,-8.53,M,41.20,M,0.00,0000*6C", "gga", true},
+		{vdo + "*" + nmea.Checksum(vdo[1:]), "vdo", true},
+		{"!AIVDM,1,1,,A,18;Or00w1mPrD:dO`=bD@3LN08;b,0*2E", "", false},
+	}
+
+	for _, tc := range cases {
+		msg := acceptLine("test", tc.line)
+		if msg == nil {
+			t.Fatalf("line not accepted: %s", tc.line)
+		}
+		fix, ok := ownShipFixFrom(msg)
+		if ok != tc.ok || fix.Source != tc.source {
+			t.Errorf("%s: got %v %q, want %v %q", tc.line, ok, fix.Source, tc.ok, tc.source)
+		}
+	}
+}
+
+func TestOwnShipPriority(t *testing.T) {
+	own := newOwnShip(nil, []string{"rmc", "vdo"}, 10*time.Second, 0)
+	fixes := own.Output()
+	t0 := time.Now()
+
+	if !own.update(ownShipFix{Lat: 1, Time: t0, Source: "rmc"}) {
+		t.Error("rmc should be used")
+	}
+	if own.update(ownShipFix{Lat: 2, Time: t0.Add(5 * time.Second), Source: "vdo"}) {
+		t.Error("vdo should not be used while rmc is active")
+	}
+	if !own.update(ownShipFix{Lat: 3, Time: t0.Add(15 * time.Second), Source: "vdo"}) {
+		t.Error("vdo should be used after rmc timed out")
+	}
+	if own.update(ownShipFix{Lat: 4, Time: t0.Add(15 * time.Second), Source: "gll"}) {
+		t.Error("gll is not a configured source")
+	}
+	if !own.update(ownShipFix{Lat: 5, Time: t0.Add(16 * time.Second), Source: "rmc"}) {
+		t.Error("rmc should be used again")
+	}
+
+	var lats []float64
+	for len(fixes) > 0 {
+		lats = append(lats, (<-fixes).Lat)
+	}
+	if len(lats) != 3 || lats[0] != 1 || lats[1] != 3 || lats[2] != 5 {
+		t.Errorf("unexpected fixes: %v", lats)
+	}
+	if fix, ok := own.Fix(t0.Add(16 * time.Second)); !ok || fix.Source != "rmc" {
+		t.Errorf("unexpected current fix: %+v", fix)
+	}
+}
+
+func TestCountGPXInput(t *testing.T) {
+	input := testutil.ToFloat64(gpxInputMessages)
+	failed := testutil.ToFloat64(gpxBadMessages) + testutil.ToFloat64(gpxUnsupportedMessages)
+	for _, line := range []string{
+		"$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6A",
+		"$GPZZZ,1*00",
+		"!AIVDM,1,1,,A,18;Or00w1mPrD:dO`=bD@3LN08;b,0*2E",
+	} {
+		countGPXInput(&Message{Raw: line})
+	}
+
+	// AIS isn't counted, as it never was.
+	if v := testutil.ToFloat64(gpxInputMessages) - input; v != 2 {
+		t.Errorf("input messages: %v, want 2", v)
+	}
+	if v := testutil.ToFloat64(gpxBadMessages) + testutil.ToFloat64(gpxUnsupportedMessages) - failed; v != 1 {
+		t.Errorf("bad and unsupported messages: %v, want 1", v)
+	}
+}
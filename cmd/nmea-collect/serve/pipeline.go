@@ -0,0 +1,526 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/thejerf/suture/v4"
+	"golang.org/x/exp/slices"
+	"golang.org/x/exp/slog"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// pipelineStopTimeout is how long we wait for a removed service to
+	// stop.
+	pipelineStopTimeout = 10 * time.Second
+	// pipelineFailingWindow is how long after a failure a service is
+	// reported as failing.
+	pipelineFailingWindow = time.Minute
+)
+
+var errPipelineNotFound = errors.New("no such service")
+
+// pipeline runs the inputs, tees and outputs from the configuration file.
+// When the configuration changes, only the services whose configuration
+// changed, or that read from a tee that changed, are restarted.
+type pipeline struct {
+	sup    *suture.Supervisor
+	input  chan<- *Message
+	main   *Tee
+	logger *slog.Logger
+	path   string // configuration file, if any
+	save   bool   // whether to save changes to the configuration file
+
+	mut     sync.Mutex
+	cfg     *pipelineConfig
+	running map[string]*pipelineService // kind/name -> service
+
+	// Failures are kept separately, as they are recorded by the
+	// supervisor while we may be waiting for it with the lock held.
+	failMut  sync.Mutex
+	failures map[string]*pipelineFailures // service string -> failures
+}
+
+type pipelineService struct {
+	kind    string // input, tee or output
+	name    string
+	from    string // the tee read from, for tees and outputs
+	cfg     any    // the configuration entry, for comparison
+	service suture.Service
+	token   suture.ServiceToken
+	src     *Tee            // the tee read from
+	c       <-chan *Message // our output of that tee
+	tee     *Tee            // for tees, the tee itself
+	started time.Time
+
+	// For tees and outputs, set by build and used by start to connect
+	// the service to its tee.
+	filter  *messageFilter
+	policy  teePolicy
+	buffer  int
+	connect func(c <-chan *Message) suture.Service
+}
+
+type pipelineFailures struct {
+	count int
+	last  time.Time
+	err   string
+}
+
+// pipelineServiceStatus is the state of a service, as reported by the
+// admin API.
+type pipelineServiceStatus struct {
+	Kind        string          `json:"kind"`
+	Name        string          `json:"name"`
+	From        string          `json:"from,omitempty"`
+	Service     string          `json:"service"`
+	State       string          `json:"state"`
+	Started     time.Time       `json:"started"`
+	Failures    int             `json:"failures"`
+	LastFailure *time.Time      `json:"last_failure,omitempty"`
+	LastError   string          `json:"last_error,omitempty"`
+	Queue       *teeOutputStats `json:"queue,omitempty"`
+	Config      any             `json:"config"`
+}
+
+func newPipeline(input chan<- *Message, main *Tee, logger *slog.Logger, path string, save bool) *pipeline {
+	p := &pipeline{
+		input:    input,
+		main:     main,
+		logger:   logger,
+		path:     path,
+		save:     save,
+		cfg:      &pipelineConfig{},
+		running:  make(map[string]*pipelineService),
+		failures: make(map[string]*pipelineFailures),
+	}
+	p.sup = suture.New("pipeline", suture.Spec{EventHook: p.event})
+	return p
+}
+
+func (p *pipeline) String() string {
+	return fmt.Sprintf("pipeline@%p", p)
+}
+
+func (p *pipeline) Serve(ctx context.Context) error {
+	return p.sup.Serve(ctx)
+}
+
+// event records service failures for the status report.
+func (p *pipeline) event(ev suture.Event) {
+	p.logger.Error(ev.String())
+	term, ok := ev.(suture.EventServiceTerminate)
+	if !ok {
+		return
+	}
+	p.failMut.Lock()
+	defer p.failMut.Unlock()
+	f, ok := p.failures[term.ServiceName]
+	if !ok {
+		f = new(pipelineFailures)
+		p.failures[term.ServiceName] = f
+	}
+	f.count++
+	f.last = time.Now()
+	f.err = fmt.Sprint(term.Err)
+}
+
+// ReloadOnSignal reloads the configuration file on SIGHUP, until the
+// context is cancelled. A configuration that fails to load is logged and
+// otherwise ignored.
+func (p *pipeline) ReloadOnSignal(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-hup:
+			p.logger.Info("Reloading pipeline configuration", "file", p.path)
+			cfg, err := loadPipelineConfig(p.path)
+			if err != nil {
+				p.logger.Error("Loading pipeline configuration", "error", err)
+				continue
+			}
+			if err := p.Apply(cfg); err != nil {
+				p.logger.Error("Applying pipeline configuration", "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Apply makes the running services match the configuration, which must
+// have been validated on its own. It's additionally checked against the
+// outputs of the main tee.
+func (p *pipeline) Apply(cfg *pipelineConfig) error {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	if err := cfg.validate(p.mainOutputs()); err != nil {
+		return err
+	}
+	return p.apply(cfg, "")
+}
+
+// Update changes a copy of the current configuration using the given
+// function, validates and applies it, and saves it to the configuration
+// file if enabled.
+func (p *pipeline) Update(fn func(cfg *pipelineConfig) error) error {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	cfg := &pipelineConfig{
+		Inputs:  slices.Clone(p.cfg.Inputs),
+		Tees:    slices.Clone(p.cfg.Tees),
+		Outputs: slices.Clone(p.cfg.Outputs),
+	}
+	if err := fn(cfg); err != nil {
+		return err
+	}
+	cfg.setDefaults()
+	if err := cfg.validate(p.mainOutputs()); err != nil {
+		return err
+	}
+	if err := p.apply(cfg, ""); err != nil {
+		return err
+	}
+	if p.save {
+		return p.saveConfig()
+	}
+	return nil
+}
+
+// Restart stops and starts the service, and any reading from it.
+func (p *pipeline) Restart(kind, name string) error {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	key := kind + "/" + name
+	if _, ok := p.running[key]; !ok {
+		return errPipelineNotFound
+	}
+	return p.apply(p.cfg, key)
+}
+
+// apply makes the running services match the configuration, additionally
+// restarting the service with the given key. Everything to be started is
+// built first, so that if anything fails, nothing has changed. The caller
+// must hold the lock.
+func (p *pipeline) apply(cfg *pipelineConfig, restart string) error {
+	type entry struct {
+		kind, name, from string
+		cfg              any
+	}
+	var want []entry
+	for _, in := range cfg.Inputs {
+		in.line = 0
+		want = append(want, entry{"input", in.Name, "", in})
+	}
+	for _, t := range cfg.Tees {
+		t.line = 0
+		want = append(want, entry{"tee", t.Name, t.From, t})
+	}
+	for _, o := range cfg.Outputs {
+		o.line = 0
+		want = append(want, entry{"output", o.Name, o.From, o})
+	}
+	wanted := make(map[string]entry, len(want))
+	for _, e := range want {
+		wanted[e.kind+"/"+e.name] = e
+	}
+
+	// Stop what was removed or changed, and everything reading from a tee
+	// that is stopped.
+	stop := make(map[string]bool)
+	for key, svc := range p.running {
+		if e, ok := wanted[key]; !ok || key == restart || e.from != svc.from || !reflect.DeepEqual(e.cfg, svc.cfg) {
+			stop[key] = true
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for key, svc := range p.running {
+			if !stop[key] && svc.from != "" && stop["tee/"+svc.from] {
+				stop[key] = true
+				changed = true
+			}
+		}
+	}
+
+	var build []*pipelineService
+	for _, e := range want {
+		key := e.kind + "/" + e.name
+		if _, ok := p.running[key]; ok && !stop[key] {
+			continue
+		}
+		svc, err := p.build(e.kind, e.name, e.from, e.cfg)
+		if err != nil {
+			return fmt.Errorf("%s %q: %w", e.kind, e.name, err)
+		}
+		build = append(build, svc)
+	}
+
+	for len(stop) > 0 {
+		// Stop services nothing else reads from first.
+		for key := range stop {
+			svc := p.running[key]
+			if svc.kind == "tee" && p.hasReaders(svc.name, stop, key) {
+				continue
+			}
+			p.stop(svc)
+			delete(stop, key)
+		}
+	}
+
+	// Start what isn't running, in order, so that tees exist before their
+	// readers.
+	p.cfg = cfg
+	for _, svc := range build {
+		p.start(svc)
+		p.running[svc.kind+"/"+svc.name] = svc
+	}
+	return nil
+}
+
+func (p *pipeline) hasReaders(tee string, stopping map[string]bool, self string) bool {
+	for key := range stopping {
+		if key != self && p.running[key].from == tee {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *pipeline) stop(svc *pipelineService) {
+	p.logger.Info("Stopping pipeline service", "kind", svc.kind, "name", svc.name)
+	if svc.src != nil {
+		svc.src.RemoveOutput(svc.c)
+	}
+	if err := p.sup.RemoveAndWait(svc.token, pipelineStopTimeout); err != nil {
+		p.logger.Warn("Stopping pipeline service", "kind", svc.kind, "name", svc.name, "error", err)
+	}
+	delete(p.running, svc.kind+"/"+svc.name)
+	p.failMut.Lock()
+	delete(p.failures, fmt.Sprint(svc.service))
+	p.failMut.Unlock()
+}
+
+// build prepares the service without starting it or connecting it to
+// anything, so that nothing has changed if it fails.
+func (p *pipeline) build(kind, name, from string, cfg any) (*pipelineService, error) {
+	svc := &pipelineService{kind: kind, name: name, from: from, cfg: cfg}
+	switch cfg := cfg.(type) {
+	case pipelineInput:
+		var err error
+		svc.service, err = p.newInput(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+	case pipelineTee:
+		filter, err := parseFilter("", cfg.Filter)
+		if err != nil {
+			return nil, err
+		}
+		svc.policy, err = parseTeePolicy(cfg.Policy)
+		if err != nil {
+			return nil, err
+		}
+		svc.buffer = cfg.Buffer
+		svc.connect = func(c <-chan *Message) suture.Service {
+			svc.tee = NewFilteredTee(name, c, filter)
+			return svc.tee
+		}
+
+	case pipelineOutput:
+		var err error
+		svc.filter, err = parseFilter(name, cfg.Filter)
+		if err != nil {
+			return nil, err
+		}
+		svc.policy, err = parseTeePolicy(cfg.Policy)
+		if err != nil {
+			return nil, err
+		}
+		svc.buffer = cfg.Buffer
+		decimate, err := parseDecimator(name, cfg.Decimate)
+		if err != nil {
+			return nil, err
+		}
+		switch cfg.Type {
+		case "udp":
+			svc.connect = func(c <-chan *Message) suture.Service {
+				return forwardUDP(c, cfg.Addrs, cfg.MaxPacketSize, cfg.MaxDelay, cfg.StripTagBlock, decimate)
+			}
+		case "tcp":
+			inject, err := newTCPInjector(cfg.Inject, p.input, p.main, cfg.InjectTo)
+			if err != nil {
+				return nil, err
+			}
+			svc.connect = func(c <-chan *Message) suture.Service {
+				return forwardTCP(c, cfg.Addr, cfg.StripTagBlock, decimate, inject, cfg.ReplayMaxAge)
+			}
+		case "serial":
+			serialCfg, err := parseSerialOutputConfig(cfg.Addr)
+			if err != nil {
+				return nil, err
+			}
+			svc.connect = func(c <-chan *Message) suture.Service {
+				return forwardSerial(c, serialCfg, cfg.Priority, cfg.MaxDelay, decimate)
+			}
+		case "raw":
+			svc.connect = func(c <-chan *Message) suture.Service {
+				return collectRAW(cfg.Pattern, cfg.WriteBuffer, cfg.TimeWindow, cfg.FlushInterval, !cfg.Uncompressed, cfg.StripTagBlock, c)
+			}
+		default:
+			return nil, fmt.Errorf("unknown output type %q", cfg.Type)
+		}
+	}
+	return svc, nil
+}
+
+// start connects the built service to the tee it reads from, if any, and
+// starts it. The tee must be running.
+func (p *pipeline) start(svc *pipelineService) {
+	if svc.connect != nil {
+		svc.src = p.tee(svc.from)
+		svc.c = svc.src.FilteredOutput(svc.name, svc.filter, svc.policy, svc.buffer)
+		svc.service = svc.connect(svc.c)
+	}
+	p.logger.Info("Starting pipeline service", "kind", svc.kind, "name", svc.name)
+	svc.token = p.sup.Add(svc.service)
+	svc.started = time.Now()
+}
+
+func (p *pipeline) newInput(cfg pipelineInput) (suture.Service, error) {
+	switch cfg.Type {
+	case "tcp-connect":
+		return readTCPInto(p.input, cfg.Addr), nil
+	case "tcp-listen":
+		return listenTCPInto(p.input, cfg.Addr), nil
+	case "udp":
+		return readUDPInto(p.input, cfg.Addr)
+	case "http":
+		port, err := strconv.Atoi(cfg.Addr)
+		if err != nil {
+			return nil, err
+		}
+		return readHTTPInto(p.input, port, cfg.Token), nil
+	case "serial":
+		serialCfg, err := parseSerialConfig(cfg.Addr)
+		if err != nil {
+			return nil, err
+		}
+		return readSerialInto(p.input, serialCfg), nil
+	default:
+		return nil, fmt.Errorf("unknown input type %q", cfg.Type)
+	}
+}
+
+// mainOutputs returns the names of the main tee's outputs other than
+// those of the pipeline. The caller must hold the lock.
+func (p *pipeline) mainOutputs() map[string]bool {
+	names := make(map[string]bool)
+	for _, name := range p.main.OutputNames() {
+		names[name] = true
+	}
+	for _, svc := range p.running {
+		if svc.src == p.main {
+			delete(names, svc.name)
+		}
+	}
+	return names
+}
+
+// tee returns the named tee, which must be running.
+func (p *pipeline) tee(name string) *Tee {
+	if name == "main" {
+		return p.main
+	}
+	return p.running["tee/"+name].tee
+}
+
+// Status returns the state of all services, in configuration order.
+func (p *pipeline) Status(now time.Time) []pipelineServiceStatus {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	var keys []string
+	for _, in := range p.cfg.Inputs {
+		keys = append(keys, "input/"+in.Name)
+	}
+	for _, t := range p.cfg.Tees {
+		keys = append(keys, "tee/"+t.Name)
+	}
+	for _, o := range p.cfg.Outputs {
+		keys = append(keys, "output/"+o.Name)
+	}
+
+	res := make([]pipelineServiceStatus, 0, len(keys))
+	for _, key := range keys {
+		svc, ok := p.running[key]
+		if !ok {
+			continue
+		}
+		st := pipelineServiceStatus{
+			Kind:    svc.kind,
+			Name:    svc.name,
+			From:    svc.from,
+			Service: fmt.Sprint(svc.service),
+			State:   "running",
+			Started: svc.started,
+			Config:  svc.cfg,
+		}
+		if in, ok := svc.cfg.(pipelineInput); ok && in.Token != "" {
+			in.Token = "REDACTED"
+			st.Config = in
+		}
+		p.failMut.Lock()
+		if f, ok := p.failures[st.Service]; ok {
+			last := f.last
+			st.Failures, st.LastFailure, st.LastError = f.count, &last, f.err
+			if now.Sub(last) < pipelineFailingWindow {
+				st.State = "failing"
+			}
+		}
+		p.failMut.Unlock()
+		if svc.src != nil {
+			if stats, ok := svc.src.OutputStats(svc.c); ok {
+				st.Queue = &stats
+			}
+		}
+		res = append(res, st)
+	}
+	return res
+}
+
+// saveConfig writes the current configuration to the configuration file.
+// The caller must hold the lock.
+func (p *pipeline) saveConfig() error {
+	bs, err := yaml.Marshal(p.cfg)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p.path), filepath.Base(p.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(bs); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p.path)
+}
@@ -0,0 +1,372 @@
+package serve
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// pipelineConfig describes inputs, tees and outputs in addition to those
+// given on the command line. It's read from a YAML file such as:
+//
+//	inputs:
+//	  - name: plotter
+//	    type: tcp-connect
+//	    addr: 172.16.1.2:2000
+//	tees:
+//	  - name: ais-feed
+//	    filter: prefix:!AI
+//	outputs:
+//	  - name: aggregator
+//	    type: udp
+//	    from: ais-feed
+//	    addrs: [5.9.207.224:5321]
+//	    decimate: ["1m ais:1,2,3,18"]
+//
+// Tees and outputs read from the main tee, or from a tee defined earlier
+// in the file.
+type pipelineConfig struct {
+	Inputs  []pipelineInput  `yaml:"inputs,omitempty" json:"inputs"`
+	Tees    []pipelineTee    `yaml:"tees,omitempty" json:"tees"`
+	Outputs []pipelineOutput `yaml:"outputs,omitempty" json:"outputs"`
+}
+
+type pipelineInput struct {
+	Name  string `yaml:"name,omitempty" json:"name,omitempty"`
+	Type  string `yaml:"type,omitempty" json:"type,omitempty"`   // tcp-connect, tcp-listen, udp, http or serial
+	Addr  string `yaml:"addr,omitempty" json:"addr,omitempty"`   // address, port or device, as for the corresponding flag
+	Token string `yaml:"token,omitempty" json:"token,omitempty"` // for http
+
+	line int
+}
+
+type pipelineTee struct {
+	Name   string `yaml:"name,omitempty" json:"name,omitempty"`
+	From   string `yaml:"from,omitempty" json:"from,omitempty"`
+	Filter string `yaml:"filter,omitempty" json:"filter,omitempty"`
+	Policy string `yaml:"policy,omitempty" json:"policy,omitempty"`
+	Buffer int    `yaml:"buffer,omitempty" json:"buffer,omitempty"`
+
+	line int
+}
+
+type pipelineOutput struct {
+	Name     string   `yaml:"name,omitempty" json:"name,omitempty"`
+	Type     string   `yaml:"type,omitempty" json:"type,omitempty"` // udp, tcp, raw or serial
+	From     string   `yaml:"from,omitempty" json:"from,omitempty"`
+	Filter   string   `yaml:"filter,omitempty" json:"filter,omitempty"`
+	Decimate []string `yaml:"decimate,omitempty" json:"decimate,omitempty"`
+	Policy   string   `yaml:"policy,omitempty" json:"policy,omitempty"`
+	Buffer   int      `yaml:"buffer,omitempty" json:"buffer,omitempty"`
+
+	StripTagBlock bool `yaml:"strip-tag-block,omitempty" json:"strip-tag-block,omitempty"`
+
+	// tcp, and serial for the device
+	Addr         string        `yaml:"addr,omitempty" json:"addr,omitempty"`
+	Inject       []string      `yaml:"inject,omitempty" json:"inject,omitempty"`                 // sentence types clients may send
+	InjectTo     string        `yaml:"inject-to,omitempty" json:"inject-to,omitempty"`           // output of the main tee to send them to, instead of the input
+	ReplayMaxAge time.Duration `yaml:"replay-max-age,omitempty" json:"replay-max-age,omitempty"` // for the latest sentences sent to new clients
+
+	// udp, and serial for max-delay
+	Addrs         []string      `yaml:"addrs,omitempty" json:"addrs,omitempty"`
+	MaxPacketSize int           `yaml:"max-packet-size,omitempty" json:"max-packet-size,omitempty"`
+	MaxDelay      time.Duration `yaml:"max-delay,omitempty" json:"max-delay,omitempty"`
+
+	// serial
+	Priority []string `yaml:"priority,omitempty" json:"priority,omitempty"`
+
+	// raw
+	Pattern       string        `yaml:"pattern,omitempty" json:"pattern,omitempty"`
+	WriteBuffer   int           `yaml:"write-buffer,omitempty" json:"write-buffer,omitempty"`
+	Uncompressed  bool          `yaml:"uncompressed,omitempty" json:"uncompressed,omitempty"`
+	TimeWindow    time.Duration `yaml:"time-window,omitempty" json:"time-window,omitempty"`
+	FlushInterval time.Duration `yaml:"flush-interval,omitempty" json:"flush-interval,omitempty"`
+
+	line int
+}
+
+// loadPipelineConfig reads and validates the configuration file. Errors
+// refer to the file and line of the offending entry.
+func loadPipelineConfig(path string) (*pipelineConfig, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := parsePipelineConfig(bs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func parsePipelineConfig(bs []byte) (*pipelineConfig, error) {
+	var cfg pipelineConfig
+	dec := yaml.NewDecoder(bytes.NewReader(bs))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(bs, &root); err != nil {
+		return nil, err
+	}
+	for i, line := range pipelineItemLines(&root, "inputs") {
+		cfg.Inputs[i].line = line
+	}
+	for i, line := range pipelineItemLines(&root, "tees") {
+		cfg.Tees[i].line = line
+	}
+	for i, line := range pipelineItemLines(&root, "outputs") {
+		cfg.Outputs[i].line = line
+	}
+
+	cfg.setDefaults()
+	if err := cfg.validate(nil); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// pipelineItemLines returns the line of each item in the top level list.
+func pipelineItemLines(root *yaml.Node, key string) []int {
+	if root.Kind != yaml.DocumentNode || len(root.Content) == 0 {
+		return nil
+	}
+	m := root.Content[0]
+	if m.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value != key {
+			continue
+		}
+		var lines []int
+		for _, item := range m.Content[i+1].Content {
+			lines = append(lines, item.Line)
+		}
+		return lines
+	}
+	return nil
+}
+
+func (c *pipelineConfig) setDefaults() {
+	for i := range c.Tees {
+		t := &c.Tees[i]
+		if t.From == "" {
+			t.From = "main"
+		}
+		if t.Policy == "" {
+			t.Policy = teeDropNewest.String()
+		}
+	}
+	for i := range c.Outputs {
+		o := &c.Outputs[i]
+		if o.From == "" {
+			o.From = "main"
+		}
+		switch o.Type {
+		case "udp":
+			if o.Policy == "" {
+				o.Policy = teeDropNewest.String()
+			}
+			if o.MaxPacketSize == 0 {
+				o.MaxPacketSize = 1472
+			}
+			if o.MaxDelay == 0 {
+				o.MaxDelay = time.Second
+			}
+		case "tcp":
+			if o.Policy == "" {
+				o.Policy = teeDropOldest.String()
+			}
+		case "serial":
+			if o.Policy == "" {
+				o.Policy = teeDropNewest.String()
+			}
+			if o.MaxDelay == 0 {
+				o.MaxDelay = time.Second
+			}
+		case "raw":
+			if o.Policy == "" {
+				o.Policy = teeBlock.String()
+			}
+			if o.WriteBuffer == 0 {
+				o.WriteBuffer = 131072
+			}
+			if o.TimeWindow == 0 {
+				o.TimeWindow = 24 * time.Hour
+			}
+			if o.FlushInterval == 0 {
+				o.FlushInterval = 5 * time.Minute
+			}
+		}
+	}
+}
+
+// validate checks everything that can be checked without starting the
+// services, returning all errors found. Tees and outputs reading from the
+// main tee must not reuse the names of its other outputs, given as
+// mainOutputs when known, and sentences from TCP clients must be injected
+// into an existing output of it.
+func (c *pipelineConfig) validate(mainOutputs map[string]bool) error {
+	var errs []error
+	fail := func(line int, kind, name, format string, args ...any) {
+		err := fmt.Errorf("%s %q: %s", kind, name, fmt.Sprintf(format, args...))
+		if line > 0 {
+			err = fmt.Errorf("line %d: %w", line, err)
+		}
+		errs = append(errs, err)
+	}
+
+	names := make(map[string]bool)
+	for _, in := range c.Inputs {
+		switch {
+		case in.Name == "":
+			fail(in.line, "input", in.Name, "missing name")
+		case names[in.Name]:
+			fail(in.line, "input", in.Name, "duplicate name")
+		}
+		names[in.Name] = true
+		if in.Addr == "" {
+			fail(in.line, "input", in.Name, "missing addr")
+			continue
+		}
+		switch in.Type {
+		case "tcp-connect", "tcp-listen":
+			if _, _, err := net.SplitHostPort(in.Addr); err != nil {
+				fail(in.line, "input", in.Name, "%v", err)
+			}
+		case "udp":
+			if _, err := readUDPInto(nil, in.Addr); err != nil {
+				fail(in.line, "input", in.Name, "%v", err)
+			}
+		case "http":
+			if _, err := strconv.Atoi(in.Addr); err != nil {
+				fail(in.line, "input", in.Name, "addr must be a port number")
+			}
+		case "serial":
+			if _, err := parseSerialConfig(in.Addr); err != nil {
+				fail(in.line, "input", in.Name, "%v", err)
+			}
+		default:
+			fail(in.line, "input", in.Name, "unknown type %q (want tcp-connect, tcp-listen, udp, http or serial)", in.Type)
+		}
+	}
+
+	onMain := make(map[string]bool, len(mainOutputs))
+	for name := range mainOutputs {
+		onMain[name] = true
+	}
+	tees := map[string]bool{"main": true}
+	for _, t := range c.Tees {
+		switch {
+		case t.Name == "":
+			fail(t.line, "tee", t.Name, "missing name")
+		case tees[t.Name]:
+			fail(t.line, "tee", t.Name, "duplicate name")
+		case t.From == "main" && onMain[t.Name]:
+			fail(t.line, "tee", t.Name, "name already used by an output of the main tee")
+		}
+		if t.From == "main" {
+			onMain[t.Name] = true
+		}
+		if !tees[t.From] {
+			fail(t.line, "tee", t.Name, "unknown tee %q in from (tees must be defined before use)", t.From)
+		}
+		tees[t.Name] = true
+		if _, err := parseFilter("", t.Filter); err != nil {
+			fail(t.line, "tee", t.Name, "%v", err)
+		}
+		if _, err := parseTeePolicy(t.Policy); err != nil {
+			fail(t.line, "tee", t.Name, "%v", err)
+		}
+	}
+
+	var injectTo []pipelineOutput // checked once all outputs are known
+	names = make(map[string]bool)
+	for _, o := range c.Outputs {
+		switch {
+		case o.Name == "":
+			fail(o.line, "output", o.Name, "missing name")
+		case names[o.Name]:
+			fail(o.line, "output", o.Name, "duplicate name")
+		case o.From == "main" && onMain[o.Name]:
+			fail(o.line, "output", o.Name, "name already used by an output of the main tee")
+		}
+		names[o.Name] = true
+		if o.From == "main" {
+			onMain[o.Name] = true
+		}
+		if !tees[o.From] {
+			fail(o.line, "output", o.Name, "unknown tee %q in from", o.From)
+		}
+		if _, err := parseFilter("", o.Filter); err != nil {
+			fail(o.line, "output", o.Name, "%v", err)
+		}
+		if _, err := parseTeePolicy(o.Policy); err != nil {
+			fail(o.line, "output", o.Name, "%v", err)
+		}
+		switch o.Type {
+		case "udp":
+			if len(o.Addrs) == 0 {
+				fail(o.line, "output", o.Name, "missing addrs")
+			}
+		case "tcp":
+			if o.Addr == "" {
+				fail(o.line, "output", o.Name, "missing addr")
+			} else if _, _, err := net.SplitHostPort(o.Addr); err != nil {
+				fail(o.line, "output", o.Name, "%v", err)
+			}
+			if _, err := newTCPInjector(o.Inject, nil, nil, o.InjectTo); err != nil {
+				fail(o.line, "output", o.Name, "%v", err)
+			}
+		case "raw":
+			if o.Pattern == "" {
+				fail(o.line, "output", o.Name, "missing pattern")
+			}
+			if len(o.Decimate) > 0 {
+				fail(o.line, "output", o.Name, "decimation is not supported for raw outputs")
+			}
+		case "serial":
+			if _, err := parseSerialOutputConfig(o.Addr); err != nil {
+				fail(o.line, "output", o.Name, "%v", err)
+			}
+			if err := checkSentenceTypes(o.Priority); err != nil {
+				fail(o.line, "output", o.Name, "priority: %v", err)
+			}
+		default:
+			fail(o.line, "output", o.Name, "unknown type %q (want udp, tcp, raw or serial)", o.Type)
+		}
+		if o.Type == "tcp" && o.InjectTo != "" && mainOutputs != nil {
+			injectTo = append(injectTo, o)
+		}
+		if o.Type != "tcp" && (len(o.Inject) > 0 || o.InjectTo != "") {
+			fail(o.line, "output", o.Name, "injection is only supported for tcp outputs")
+		}
+		if o.Type != "tcp" && o.ReplayMaxAge != 0 {
+			fail(o.line, "output", o.Name, "replay is only supported for tcp outputs")
+		}
+		if o.Type != "serial" && len(o.Priority) > 0 {
+			fail(o.line, "output", o.Name, "priority is only supported for serial outputs")
+		}
+		if _, err := parseDecimator("", o.Decimate); err != nil {
+			fail(o.line, "output", o.Name, "%v", err)
+		}
+	}
+
+	for _, o := range injectTo {
+		if !onMain[o.InjectTo] {
+			fail(o.line, "output", o.Name, "inject-to %q is not an output of the main tee", o.InjectTo)
+		}
+	}
+
+	return errors.Join(errs...)
+}
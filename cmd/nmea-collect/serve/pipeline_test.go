@@ -0,0 +1,224 @@
+package serve
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/exp/slog"
+)
+
+func TestPipelineConfigErrors(t *testing.T) {
+	cfg := `inputs:
+  - name: plotter
+    type: tcp-connect
+    addr: 172.16.1.2:2000
+  - name: plotter
+    type: carrier-pigeon
+    addr: roof
+  - name: sensors
+    type: udp
+    addr: 239.192.0.1:notaport
+  - name: listener
+    type: tcp-listen
+    addr: "2001"
+tees:
+  - name: ais
+    from: nonexistent
+    filter: "foo:bar"
+outputs:
+  - name: aggregator
+    type: udp
+    from: ais
+    decimate: ["soon ais:1"]
+`
+	_, err := parsePipelineConfig([]byte(cfg))
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+	for _, want := range []string{
+		`line 5: input "plotter": duplicate name`,
+		`line 5: input "plotter": unknown type "carrier-pigeon"`,
+		`line 8: input "sensors": `,
+		`line 11: input "listener": address 2001: missing port in address`,
+		`line 15: tee "ais": unknown tee "nonexistent"`,
+		`line 15: tee "ais": filter "foo:bar"`,
+		`line 19: output "aggregator": missing addrs`,
+		`line 19: output "aggregator": decimation rule "soon ais:1"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error should contain %q, got:\n%v", want, err)
+		}
+	}
+
+	// Sentences from TCP clients must go to an output of the main tee,
+	// which may be defined later in the file.
+	parsed, err := parsePipelineConfig([]byte(`outputs:
+  - name: plotter
+    type: tcp
+    addr: :2000
+    inject: [RMB]
+    inject-to: autopilot
+  - name: laptop
+    type: tcp
+    addr: :2001
+    inject: [RMB]
+    inject-to: nonexistent
+  - name: autopilot
+    type: udp
+    addrs: [127.0.0.1:10110]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = parsed.validate(map[string]bool{"raw": true})
+	if err == nil || strings.Contains(err.Error(), `"plotter"`) || !strings.Contains(err.Error(), `line 7: output "laptop": inject-to "nonexistent" is not an output of the main tee`) {
+		t.Errorf("unexpected inject-to validation: %v", err)
+	}
+
+	_, err = parsePipelineConfig([]byte("outputs:\n  - name: x\n    typo: udp\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("unknown field should be an error on line 3, got %v", err)
+	}
+}
+
+func TestPipelineApply(t *testing.T) {
+	dir := t.TempDir()
+	input := make(chan *Message)
+	main := NewTee("main", input)
+	pl := newPipeline(input, main, slog.Default(), "", false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = main.Serve(ctx) }()
+	go func() { _ = pl.Serve(ctx) }()
+
+	apply := func(cfg string) {
+		t.Helper()
+		parsed, err := parsePipelineConfig([]byte(cfg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pl.Apply(parsed); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	raw := "  - name: recorder\n    type: raw\n    pattern: " + filepath.Join(dir, "raw-20060102.gz") + "\n"
+	apply(`tees:
+  - name: ais
+    filter: prefix:!AI
+outputs:
+` + raw + `  - name: aggregator
+    type: udp
+    from: ais
+    addrs: [127.0.0.1:5321]
+`)
+	recorder := pl.running["output/recorder"]
+	aggregator := pl.running["output/aggregator"]
+	ais := pl.running["tee/ais"]
+	if recorder == nil || aggregator == nil || ais == nil {
+		t.Fatal("services should be running")
+	}
+
+	// Adding an output leaves the others alone.
+	apply(`tees:
+  - name: ais
+    filter: prefix:!AI
+outputs:
+` + raw + `  - name: aggregator
+    type: udp
+    from: ais
+    addrs: [127.0.0.1:5321]
+  - name: laptop
+    type: udp
+    addrs: [127.0.0.1:10110]
+`)
+	if pl.running["output/recorder"] != recorder || pl.running["output/aggregator"] != aggregator || pl.running["tee/ais"] != ais {
+		t.Error("unchanged services should not be restarted")
+	}
+	if pl.running["output/laptop"] == nil {
+		t.Error("new output should be running")
+	}
+
+	// Changing a tee restarts what reads from it, and removed outputs are
+	// stopped.
+	apply(`tees:
+  - name: ais
+    filter: prefix:!AIVDM
+outputs:
+` + raw + `  - name: aggregator
+    type: udp
+    from: ais
+    addrs: [127.0.0.1:5321]
+`)
+	if pl.running["tee/ais"] == ais || pl.running["output/aggregator"] == aggregator {
+		t.Error("changed tee and its readers should be restarted")
+	}
+	if pl.running["output/recorder"] != recorder {
+		t.Error("recorder should not be restarted")
+	}
+	if pl.running["output/laptop"] != nil {
+		t.Error("removed output should be stopped")
+	}
+	if n := len(main.outputs); n != 2 {
+		t.Errorf("main tee should have two outputs, not %d", n)
+	}
+}
+
+func TestPipelineApplyFailure(t *testing.T) {
+	input := make(chan *Message)
+	main := NewTee("main", input)
+	main.Output("raw", teeBlock, 0)
+	pl := newPipeline(input, main, slog.Default(), "", false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = main.Serve(ctx) }()
+	go func() { _ = pl.Serve(ctx) }()
+
+	cfg, err := parsePipelineConfig([]byte(`outputs:
+  - name: laptop
+    type: udp
+    addrs: [127.0.0.1:10110]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pl.Apply(cfg); err != nil {
+		t.Fatal(err)
+	}
+	laptop := pl.running["output/laptop"]
+
+	// Names of the main tee's other outputs are taken.
+	cfg, err = parsePipelineConfig([]byte(`outputs:
+  - name: raw
+    type: udp
+    addrs: [127.0.0.1:10110]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pl.Apply(cfg); err == nil || !strings.Contains(err.Error(), "already used") {
+		t.Errorf("expected error for name used on the main tee, got %v", err)
+	}
+
+	// A configuration that fails to start changes nothing, even for the
+	// services that would otherwise have been restarted.
+	pl.mut.Lock()
+	err = pl.apply(&pipelineConfig{Outputs: []pipelineOutput{
+		{Name: "laptop", Type: "udp", From: "main", Addrs: []string{"127.0.0.1:10111"}, Policy: "drop-newest"},
+		{Name: "pigeon", Type: "carrier-pigeon", From: "main", Policy: "drop-newest"},
+	}}, "")
+	pl.mut.Unlock()
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if pl.running["output/laptop"] != laptop || len(pl.running) != 1 {
+		t.Error("running services should be unchanged")
+	}
+	if len(pl.cfg.Outputs) != 1 || pl.cfg.Outputs[0].Addrs[0] != "127.0.0.1:10110" {
+		t.Error("configuration should be unchanged")
+	}
+}
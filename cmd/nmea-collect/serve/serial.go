@@ -0,0 +1,195 @@
+package serve
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+	"golang.org/x/exp/slog"
+)
+
+// baudRates are the supported serial port speeds.
+var baudRates = []int{1200, 2400, 4800, 9600, 19200, 38400, 57600, 115200, 230400, 460800}
+
+// autoBaudRates are tried in order when the baud rate is set to "auto".
+// The common NMEA 0183 rate is first, followed by the AIS rate.
+var autoBaudRates = []int{4800, 38400, 9600, 19200, 57600, 115200}
+
+const autoBaudTimeout = 3 * time.Second
+
+// serialConfig describes a serial device and the port settings to apply
+// to it. A config without a baud rate leaves the device settings as they
+// are.
+type serialConfig struct {
+	dev      string
+	baud     int
+	autoBaud bool
+	dataBits int
+	parity   byte
+	stopBits int
+}
+
+// parseSerialConfig parses a device specification on the form
+// "/dev/ttyUSB0", "/dev/ttyUSB0@38400", "/dev/ttyUSB0@38400,8N1" or
+// "/dev/ttyUSB0@auto,8N1".
+func parseSerialConfig(s string) (serialConfig, error) {
+	dev, settings, ok := strings.Cut(s, "@")
+	cfg := serialConfig{dev: dev, dataBits: 8, parity: 'N', stopBits: 1}
+	if dev == "" {
+		return cfg, fmt.Errorf("serial %q: missing device", s)
+	}
+	if !ok {
+		return cfg, nil
+	}
+
+	baud, frame, hasFrame := strings.Cut(settings, ",")
+	if baud == "auto" {
+		cfg.autoBaud = true
+	} else {
+		v, err := strconv.Atoi(baud)
+		if err != nil || v <= 0 {
+			return cfg, fmt.Errorf("serial %q: bad baud rate %q", s, baud)
+		}
+		if !slices.Contains(baudRates, v) {
+			return cfg, fmt.Errorf("serial %q: unsupported baud rate %d", s, v)
+		}
+		cfg.baud = v
+	}
+
+	if hasFrame {
+		frame = strings.ToUpper(frame)
+		if len(frame) != 3 {
+			return cfg, fmt.Errorf("serial %q: bad frame format %q", s, frame)
+		}
+		if frame[0] < '5' || frame[0] > '8' {
+			return cfg, fmt.Errorf("serial %q: bad data bits %q", s, frame[0])
+		}
+		cfg.dataBits = int(frame[0] - '0')
+		switch frame[1] {
+		case 'N', 'E', 'O':
+			cfg.parity = frame[1]
+		default:
+			return cfg, fmt.Errorf("serial %q: bad parity %q", s, frame[1])
+		}
+		switch frame[2] {
+		case '1', '2':
+			cfg.stopBits = int(frame[2] - '0')
+		default:
+			return cfg, fmt.Errorf("serial %q: bad stop bits %q", s, frame[2])
+		}
+	}
+
+	return cfg, nil
+}
+
+func (c serialConfig) String() string {
+	switch {
+	case c.autoBaud:
+		return fmt.Sprintf("%s@auto,%d%c%d", c.dev, c.dataBits, c.parity, c.stopBits)
+	case c.baud > 0:
+		return fmt.Sprintf("%s@%d,%d%c%d", c.dev, c.baud, c.dataBits, c.parity, c.stopBits)
+	default:
+		return c.dev
+	}
+}
+
+// configured returns true if port settings should be applied to the
+// device.
+func (c serialConfig) configured() bool {
+	return c.baud > 0 || c.autoBaud
+}
+
+// bytesPerSecond returns the throughput of the port, with each character
+// framed by a start bit, the data bits, any parity bit and the stop bits.
+func (c serialConfig) bytesPerSecond() float64 {
+	bits := 1 + c.dataBits + c.stopBits
+	if c.parity != 'N' {
+		bits++
+	}
+	return float64(c.baud) / float64(bits)
+}
+
+// parseSerialOutputConfig is like parseSerialConfig, for devices we write
+// to. These need a fixed baud rate.
+func parseSerialOutputConfig(s string) (serialConfig, error) {
+	cfg, err := parseSerialConfig(s)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.baud == 0 {
+		return cfg, fmt.Errorf("serial %q: output needs a baud rate (e.g., %s@4800)", s, cfg.dev)
+	}
+	return cfg, nil
+}
+
+func openSerial(cfg serialConfig) (io.ReadCloser, error) {
+	if !cfg.configured() {
+		return os.Open(cfg.dev)
+	}
+
+	fd, err := openSerialDevice(cfg.dev)
+	if err != nil {
+		return nil, fmt.Errorf("reader: %w", err)
+	}
+
+	if !cfg.autoBaud {
+		if err := configureSerial(fd, cfg, cfg.baud); err != nil {
+			fd.Close()
+			return nil, fmt.Errorf("reader: %s: %w", cfg.dev, err)
+		}
+		return fd, nil
+	}
+
+	for _, baud := range autoBaudRates {
+		if err := configureSerial(fd, cfg, baud); err != nil {
+			fd.Close()
+			return nil, fmt.Errorf("reader: %s: %w", cfg.dev, err)
+		}
+		if detectNMEA(fd, autoBaudTimeout) {
+			slog.Info("Detected serial baud rate", "dev", cfg.dev, "baud", baud)
+			return fd, nil
+		}
+	}
+
+	fd.Close()
+	return nil, fmt.Errorf("reader: %s: no valid NMEA at any baud rate", cfg.dev)
+}
+
+// openSerialOutput opens the device for writing, with the port settings
+// from the config.
+func openSerialOutput(cfg serialConfig) (io.WriteCloser, error) {
+	fd, err := openSerialDevice(cfg.dev)
+	if err != nil {
+		return nil, fmt.Errorf("writer: %w", err)
+	}
+	if err := configureSerial(fd, cfg, cfg.baud); err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("writer: %s: %w", cfg.dev, err)
+	}
+	return fd, nil
+}
+
+// detectNMEA returns true if a valid, checksummed NMEA sentence is read
+// from the device before the timeout expires.
+func detectNMEA(fd *os.File, timeout time.Duration) bool {
+	if err := fd.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return false
+	}
+	defer fd.SetReadDeadline(time.Time{})
+
+	br := bufio.NewReaderSize(fd, 1024)
+	for {
+		line, err := br.ReadString('\n')
+		if checksumOK(strings.TrimSpace(line)) {
+			return true
+		}
+		if err != nil {
+			return false
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package serve
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+var termiosBaudRates = map[int]uint32{
+	1200:   unix.B1200,
+	2400:   unix.B2400,
+	4800:   unix.B4800,
+	9600:   unix.B9600,
+	19200:  unix.B19200,
+	38400:  unix.B38400,
+	57600:  unix.B57600,
+	115200: unix.B115200,
+	230400: unix.B230400,
+	460800: unix.B460800,
+}
+
+func openSerialDevice(dev string) (*os.File, error) {
+	// Non blocking mode makes the file pollable, so that read deadlines
+	// work.
+	return os.OpenFile(dev, os.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK, 0)
+}
+
+// configureSerial puts the port in raw mode with the given baud rate and
+// the frame format from the config, and discards any pending input.
+func configureSerial(fd *os.File, cfg serialConfig, baud int) error {
+	speed, ok := termiosBaudRates[baud]
+	if !ok {
+		return fmt.Errorf("unsupported baud rate %d", baud)
+	}
+
+	rc, err := fd.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var terr error
+	if err := rc.Control(func(fd uintptr) {
+		terr = setTermios(int(fd), cfg, speed)
+	}); err != nil {
+		return err
+	}
+	return terr
+}
+
+func setTermios(fd int, cfg serialConfig, speed uint32) error {
+	t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return fmt.Errorf("get termios: %w", err)
+	}
+
+	// Raw mode, as per cfmakeraw(3)
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON | unix.IXOFF | unix.INPCK
+	t.Oflag &^= unix.OPOST
+	t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	t.Cflag &^= unix.CSIZE | unix.PARENB | unix.PARODD | unix.CSTOPB | unix.CBAUD | unix.CRTSCTS
+	t.Cflag |= unix.CLOCAL | unix.CREAD | speed
+	t.Cc[unix.VMIN] = 1
+	t.Cc[unix.VTIME] = 0
+
+	switch cfg.dataBits {
+	case 5:
+		t.Cflag |= unix.CS5
+	case 6:
+		t.Cflag |= unix.CS6
+	case 7:
+		t.Cflag |= unix.CS7
+	default:
+		t.Cflag |= unix.CS8
+	}
+
+	switch cfg.parity {
+	case 'E':
+		t.Cflag |= unix.PARENB
+		t.Iflag |= unix.INPCK
+	case 'O':
+		t.Cflag |= unix.PARENB | unix.PARODD
+		t.Iflag |= unix.INPCK
+	}
+
+	if cfg.stopBits == 2 {
+		t.Cflag |= unix.CSTOPB
+	}
+
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, t); err != nil {
+		return fmt.Errorf("set termios: %w", err)
+	}
+	if err := unix.IoctlSetInt(fd, unix.TCFLSH, unix.TCIFLUSH); err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+	return nil
+}
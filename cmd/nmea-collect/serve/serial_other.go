@@ -0,0 +1,18 @@
+//go:build !linux
+
+package serve
+
+import (
+	"errors"
+	"os"
+)
+
+var errSerialUnsupported = errors.New("serial port configuration is only supported on Linux")
+
+func openSerialDevice(dev string) (*os.File, error) {
+	return nil, errSerialUnsupported
+}
+
+func configureSerial(fd *os.File, cfg serialConfig, baud int) error {
+	return errSerialUnsupported
+}
@@ -0,0 +1,34 @@
+package serve
+
+import (
+	"testing"
+)
+
+func TestParseSerialConfig(t *testing.T) {
+	cases := []struct {
+		in   string
+		want serialConfig
+	}{
+		{"/dev/ttyS0", serialConfig{dev: "/dev/ttyS0", dataBits: 8, parity: 'N', stopBits: 1}},
+		{"/dev/ttyUSB0@38400", serialConfig{dev: "/dev/ttyUSB0", baud: 38400, dataBits: 8, parity: 'N', stopBits: 1}},
+		{"/dev/ttyUSB0@4800,7e2", serialConfig{dev: "/dev/ttyUSB0", baud: 4800, dataBits: 7, parity: 'E', stopBits: 2}},
+		{"/dev/ttyUSB0@auto,8O1", serialConfig{dev: "/dev/ttyUSB0", autoBaud: true, dataBits: 8, parity: 'O', stopBits: 1}},
+	}
+	for _, c := range cases {
+		got, err := parseSerialConfig(c.in)
+		if err != nil {
+			t.Errorf("parseSerialConfig(%q): %v", c.in, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("parseSerialConfig(%q) == %+v, want %+v", c.in, got, c.want)
+		}
+	}
+
+	bad := []string{"", "@4800", "/dev/ttyS0@fast", "/dev/ttyS0@1234", "/dev/ttyS0@4800,9N1", "/dev/ttyS0@4800,8X1", "/dev/ttyS0@4800,8N3", "/dev/ttyS0@4800,8N"}
+	for _, in := range bad {
+		if _, err := parseSerialConfig(in); err == nil {
+			t.Errorf("parseSerialConfig(%q) should fail", in)
+		}
+	}
+}
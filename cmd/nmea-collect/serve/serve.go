@@ -2,36 +2,67 @@ package serve
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"time"
 
+	"calmh.dev/nmea-collect/internal/aisregistry"
 	"calmh.dev/nmea-collect/internal/gpx/writer"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/thejerf/suture/v4"
+	"golang.org/x/exp/slices"
 	"golang.org/x/exp/slog"
 )
 
 type CLI struct {
+	Config string `help:"Configuration file with additional inputs, tees and outputs; reloaded on SIGHUP" placeholder:"FILE" group:"Pipeline"`
+
 	InputTCPConnect []string `help:"TCP connect input addresses (e.g., 172.16.1.2:2000)" placeholder:"ADDR" group:"Input"`
-	InputUDPListen  []int    `help:"UDP broadcast input listen ports (e.g., 2000)" placeholder:"PORT" group:"Input"`
-	InputHTTPListen []int    `help:"HTTP input listen ports (e.g., 8080)" placeholder:"PORT" group:"Input"`
-	InputSerial     []string `help:"Serial port inputs (e.g., /dev/ttyS0)" placeholder:"DEV" group:"Input"`
+	InputTCPListen  []string `help:"TCP listen input addresses, for senders connecting to us (e.g., :2001)" placeholder:"ADDR" group:"Input"`
+	InputUDPListen  []string `help:"UDP input listen ports or addresses, including multicast groups, optionally bound to an interface (e.g., 2000, 239.192.0.1:2000@eth0, [::]:2000)" placeholder:"ADDR" group:"Input"`
+	InputHTTPListen []int    `help:"HTTP input listen ports (e.g., 8080), accepting POSTed text, NDJSON or JSON arrays" placeholder:"PORT" group:"Input"`
+	InputHTTPToken  string   `help:"Bearer token required for HTTP input, if set" placeholder:"TOKEN" env:"NMEA_INPUT_HTTP_TOKEN" group:"Input"`
+	InputSerial     []string `help:"Serial port inputs, optionally with port settings (e.g., /dev/ttyS0, /dev/ttyUSB0@38400,8N1, /dev/ttyUSB0@auto)" placeholder:"DEV" sep:"none" group:"Input"`
 	InputStdin      bool     `help:"Read NMEA from standard input" group:"Input"`
 
 	ForwardUDPAll              []string      `help:"UDP output destination address (all NMEA)" placeholder:"ADDR" group:"UDP output"`
 	ForwardUDPAllMaxPacketSize int           `help:"Maximum UDP payload size (all NMEA)" default:"1472" group:"UDP output"`
 	ForwardUDPAllMaxDelay      time.Duration `help:"Maximum UDP buffer delay (all NMEA)" default:"1s" group:"UDP output"`
+	ForwardUDPAllStripTagBlock bool          `help:"Remove tag blocks before forwarding (all NMEA)" group:"UDP output"`
+	ForwardUDPAllFilter        string        `help:"Filter expression for forwarded sentences (all NMEA)" placeholder:"EXPR" group:"UDP output"`
+	ForwardUDPAllDecimate      []string      `help:"Decimation rules, an interval or \"drop\" and a filter expression (e.g., \"5s type:RMC\") (all NMEA)" placeholder:"RULE" sep:"none" group:"UDP output"`
 
 	ForwardUDPAIS              []string      `name:"forward-ais-udp" help:"UDP output destination address (AIS only)" placeholder:"ADDR" group:"UDP output"`
 	ForwardUDPAISMaxPacketSize int           `help:"Maximum UDP payload size (AIS only)" name:"forward-ais-udp-max-packet-size" default:"1472" group:"UDP output"`
 	ForwardUDPAISMaxDelay      time.Duration `help:"Maximum UDP buffer delay (AIS only)" name:"forward-ais-udp-max-delay" default:"10s" group:"UDP output"`
+	ForwardUDPAISStripTagBlock bool          `help:"Remove tag blocks before forwarding (AIS only)" name:"forward-ais-udp-strip-tag-block" group:"UDP output"`
+	ForwardUDPAISFilter        string        `help:"Filter expression for forwarded sentences (AIS only)" name:"forward-ais-udp-filter" placeholder:"EXPR" group:"UDP output"`
+	ForwardUDPAISDecimate      []string      `help:"Decimation rules, an interval or \"drop\" and a filter expression (e.g., \"1m ais:1,2,3\") (AIS only)" name:"forward-ais-udp-decimate" placeholder:"RULE" sep:"none" group:"UDP output"`
+
+	ForwardAllTCPListen        string        `default:":2000" help:"TCP listen address (all NMEA)" placeholder:"ADDR" group:"TCP output"`
+	ForwardAllTCPStripTagBlock bool          `help:"Remove tag blocks before forwarding (all NMEA)" group:"TCP output"`
+	ForwardAllTCPFilter        string        `help:"Filter expression for forwarded sentences (all NMEA)" placeholder:"EXPR" group:"TCP output"`
+	ForwardAllTCPDecimate      []string      `help:"Decimation rules, an interval or \"drop\" and a filter expression (e.g., \"5s type:RMC\") (all NMEA)" placeholder:"RULE" sep:"none" group:"TCP output"`
+	ForwardAllTCPInject        []string      `help:"Sentence types that clients may send to us (e.g., RMB,APB,XTE; disabled if empty)" placeholder:"TYPE" group:"TCP output"`
+	ForwardAllTCPInjectTo      string        `help:"Send sentences from clients only to this output of the main tee (e.g., udp-all), instead of to the input" placeholder:"OUTPUT" group:"TCP output"`
+	ForwardAllTCPReplayMaxAge  time.Duration `help:"Send new clients the latest of each sentence up to this old before live data (all NMEA; e.g., 10m; disabled if 0)" group:"TCP output"`
+	ForwardAISTCPListen        string        `default:":2010" name:"forward-ais-tcp-listen" help:"TCP listen address (AIS only)" placeholder:"ADDR" group:"TCP output"`
+	ForwardAISTCPStripTagBlock bool          `name:"forward-ais-tcp-strip-tag-block" help:"Remove tag blocks before forwarding (AIS only)" group:"TCP output"`
+	ForwardAISTCPFilter        string        `name:"forward-ais-tcp-filter" help:"Filter expression for forwarded sentences (AIS only)" placeholder:"EXPR" group:"TCP output"`
+	ForwardAISTCPDecimate      []string      `name:"forward-ais-tcp-decimate" help:"Decimation rules, an interval or \"drop\" and a filter expression (e.g., \"1m ais:1,2,3\") (AIS only)" placeholder:"RULE" sep:"none" group:"TCP output"`
+	ForwardAISTCPReplayMaxAge  time.Duration `name:"forward-ais-tcp-replay-max-age" help:"Send new clients the latest of each sentence up to this old before live data (AIS only; e.g., 10m; disabled if 0)" group:"TCP output"`
 
-	ForwardAllTCPListen string `default:":2000" help:"TCP listen address (all NMEA)" placeholder:"ADDR" group:"TCP output"`
-	ForwardAISTCPListen string `default:":2010" name:"forward-ais-tcp-listen" help:"TCP listen address (AIS only)" placeholder:"ADDR" group:"TCP output"`
+	OutputSerial         string        `help:"Serial device to write NMEA to, with port settings (e.g., /dev/ttyUSB1@4800; disabled if empty)" placeholder:"DEV" group:"Serial output"`
+	OutputSerialFilter   string        `help:"Filter expression for sentences written to the serial device" placeholder:"EXPR" group:"Serial output"`
+	OutputSerialDecimate []string      `help:"Decimation rules, an interval or \"drop\" and a filter expression (e.g., \"5s type:RMC\")" placeholder:"RULE" sep:"none" group:"Serial output"`
+	OutputSerialPriority []string      `help:"Sentence types in order of priority, kept when the device can't keep up while other types are dropped (e.g., RMB,APB,RMC)" placeholder:"TYPE" group:"Serial output"`
+	OutputSerialMaxDelay time.Duration `help:"Maximum time sentences wait for the device before being dropped" default:"1s" group:"Serial output"`
 
 	OutputGPXPattern         string        `default:"track-20060102-150405.gpx" help:"File naming pattern, see https://golang.org/pkg/time/#Time.Format" group:"GPX File Output"`
 	OutputGPXSampleInterval  time.Duration `help:"Time between track points" default:"10s" group:"GPX File Output"`
@@ -39,13 +70,49 @@ type CLI struct {
 	OutputGPXStartTimeWindow time.Duration `help:"Movement time window for starting track" default:"1m" group:"GPX File Output"`
 	OutputGPXStopTimeWindow  time.Duration `help:"Movement time window before ending track" default:"5m" group:"GPX File Output"`
 
+	OutputAISTrackPattern        string        `name:"output-ais-track-pattern" help:"File naming pattern for tracks of other vessels, with {mmsi} for the vessel's MMSI (e.g., ais-20060102-150405-{mmsi}.gpx, or .geojson for GeoJSON; disabled if empty)" placeholder:"PATTERN" group:"AIS Track File Output"`
+	OutputAISTrackMMSI           []uint32      `name:"output-ais-track-mmsi" help:"Record tracks only for these vessels (default is all)" placeholder:"MMSI" group:"AIS Track File Output"`
+	OutputAISTrackSampleInterval time.Duration `name:"output-ais-track-sample-interval" default:"30s" help:"Time between track points; starting and stopping tracks follows the GPX output settings" group:"AIS Track File Output"`
+	OutputAISTrackFilter         string        `name:"output-ais-track-filter" help:"Filter expression for the AIS messages to record tracks from (e.g., \"ais:1,2,3\" for class A only)" placeholder:"EXPR" group:"AIS Track File Output"`
+
 	OutputRawPattern       string        `default:"nmea-raw.20060102-150405.gz" help:"File naming pattern, see https://golang.org/pkg/time/#Time.Format" group:"Raw NMEA File Output"`
 	OutputRawBufferSize    int           `default:"131072" help:"Write buffer for output file" group:"Raw NMEA File Output"`
 	OutputRawUncompressed  bool          `help:"Write uncompressed NMEA (default is gzipped)" group:"Raw NMEA File Output"`
 	OutputRawTimeWindow    time.Duration `default:"24h" help:"How often to create a new raw file" group:"Raw NMEA File Output"`
 	OutputRawFlushInterval time.Duration `default:"5m" help:"How often to flush raw data to disk" group:"Raw NMEA File Output"`
+	OutputRawStripTagBlock bool          `help:"Remove tag blocks from recorded sentences" group:"Raw NMEA File Output"`
+	OutputRawFilter        string        `help:"Filter expression for recorded sentences" placeholder:"EXPR" group:"Raw NMEA File Output"`
+
+	AISFragmentTimeout      time.Duration   `name:"ais-fragment-timeout" default:"10s" help:"How long to wait for the remaining sentences of a multi-sentence AIS message" group:"AIS"`
+	AISContactWindows       []time.Duration `name:"ais-contact-windows" default:"5m,1h,24h" help:"Time windows to count distinct AIS contacts over" group:"AIS"`
+	AISTargetRetention      time.Duration   `name:"ais-target-retention" default:"1h" help:"How long to keep targets in the live target table after they were last seen" group:"AIS"`
+	AISCPAAlarmDistance     float64         `name:"ais-cpa-alarm-distance" default:"0.5" help:"Alarm for targets with a closest point of approach nearer than this, in nautical miles (0 to disable)" group:"AIS"`
+	AISCPAAlarmTime         time.Duration   `name:"ais-cpa-alarm-time" default:"12m" help:"Alarm only for targets reaching the closest point of approach within this time" group:"AIS"`
+	AISRegistry             string          `name:"ais-registry" placeholder:"FILE" help:"File for the persistent registry of all AIS vessels seen (disabled if empty)" group:"AIS"`
+	AISRegistrySaveInterval time.Duration   `name:"ais-registry-save-interval" default:"5m" help:"How often to save the AIS registry to disk" group:"AIS"`
+	AISCPAEmit              string          `name:"ais-cpa-emit" enum:",alr,ttm" default:"" help:"Emit CPA alarms to the outputs, except raw files, as ALR or TTM sentences (alr, ttm)" group:"AIS"`
+	AISOwnMMSI              uint32          `name:"ais-own-mmsi" placeholder:"MMSI" help:"Our own MMSI, so that our own transponder heard as a target raises no CPA alarm (taken from VDO sentences if not set)" group:"AIS"`
+	AISContactsFilter       string          `name:"ais-contacts-filter" help:"Filter expression for the AIS messages counted as contacts" placeholder:"EXPR" group:"AIS"`
+	AISTargetFilter         string          `name:"ais-target-filter" help:"Filter expression for the AIS messages kept in the live target table, and thereby used for CPA" placeholder:"EXPR" group:"AIS"`
+	AISCoverageFilter       string          `name:"ais-coverage-filter" help:"Filter expression for the AIS messages used for reception coverage" placeholder:"EXPR" group:"AIS"`
+	AISRegistryFilter       string          `name:"ais-registry-filter" help:"Filter expression for the AIS messages recorded in the registry" placeholder:"EXPR" group:"AIS"`
+
+	AISAlertEventsFile string        `name:"ais-alert-events-file" placeholder:"FILE" help:"File to append AIS safety messages and distress device reports to, as JSON lines" group:"AIS Alerts"`
+	AISAlertWebhook    string        `name:"ais-alert-webhook" placeholder:"URL" help:"URL to POST AIS alerts to, as JSON; distress device tests are only logged and recorded" group:"AIS Alerts"`
+	AISAlertExec       string        `name:"ais-alert-exec" placeholder:"CMD" help:"Command to run for AIS alerts, except distress device tests, with the alert as JSON on stdin (arguments are split on spaces, without quoting)" group:"AIS Alerts"`
+	AISAlertRepeat     time.Duration `name:"ais-alert-repeat" default:"10m" help:"Minimum time between repeated alerts for the same MMSI" group:"AIS Alerts"`
+	AISAlertFilter     string        `name:"ais-alert-filter" help:"Filter expression for the AIS messages checked for alerts" placeholder:"EXPR" group:"AIS Alerts"`
+
+	PositionSources       []string      `default:"rmc,gga,gll,vdo" enum:"rmc,gga,gll,vdo" help:"Sources for our own position, in order of priority (rmc, gga, gll, vdo)" placeholder:"SOURCE" group:"Position"`
+	PositionSourceTimeout time.Duration `default:"10s" help:"How long a source must be silent before falling back to the next one" group:"Position"`
+	PositionFilter        string        `help:"Filter expression for the sentences used for our own position, and thereby the GPX track" placeholder:"EXPR" group:"Position"`
 
 	PrometheusMetricsListen string `default:"127.0.0.1:9140" help:"HTTP listen address for Prometheus metrics endpoint" placeholder:"ADDR" group:"Metrics"`
+	InstrumentsFilter       string `help:"Filter expression for the sentences exported as instrument metrics" placeholder:"EXPR" group:"Metrics"`
+
+	AdminListen string `help:"HTTP listen address for the admin API, which may be the same as the metrics address (disabled if empty)" placeholder:"ADDR" group:"Admin"`
+	AdminToken  string `help:"Bearer token required for the admin API; optional only on a loopback address" placeholder:"TOKEN" env:"NMEA_ADMIN_TOKEN" group:"Admin"`
+	AdminSave   bool   `help:"Save changes made through the admin API to the configuration file" group:"Admin"`
 }
 
 func (cli *CLI) Run(ctx context.Context, logger *slog.Logger) error {
@@ -57,10 +124,79 @@ func (cli *CLI) Run(ctx context.Context, logger *slog.Logger) error {
 		},
 	})
 
-	input := make(chan string, 4096)
-	tee := NewTee("main", input)
+	filters := make(map[string]*messageFilter)
+	for name, expr := range map[string]string{
+		"udp-all":    cli.ForwardUDPAllFilter,
+		"udp-ais":    cli.ForwardUDPAISFilter,
+		"tcp-all":    cli.ForwardAllTCPFilter,
+		"tcp-ais":    cli.ForwardAISTCPFilter,
+		"raw":        cli.OutputRawFilter,
+		"serial":     cli.OutputSerialFilter,
+		"ais-tracks": cli.OutputAISTrackFilter,
+
+		"own-ship":     cli.PositionFilter,
+		"instruments":  cli.InstrumentsFilter,
+		"ais-contacts": cli.AISContactsFilter,
+		"ais-targets":  cli.AISTargetFilter,
+		"ais-alerts":   cli.AISAlertFilter,
+		"ais-coverage": cli.AISCoverageFilter,
+		"ais-registry": cli.AISRegistryFilter,
+	} {
+		if expr == "" {
+			continue
+		}
+		f, err := parseFilter(name, expr)
+		if err != nil {
+			return err
+		}
+		filters[name] = f
+	}
+
+	decimators := make(map[string]*decimator)
+	for name, rules := range map[string][]string{
+		"udp-all": cli.ForwardUDPAllDecimate,
+		"udp-ais": cli.ForwardUDPAISDecimate,
+		"tcp-all": cli.ForwardAllTCPDecimate,
+		"tcp-ais": cli.ForwardAISTCPDecimate,
+		"serial":  cli.OutputSerialDecimate,
+	} {
+		d, err := parseDecimator(name, rules)
+		if err != nil {
+			return err
+		}
+		decimators[name] = d
+	}
+
+	if cli.AISFragmentTimeout < time.Millisecond {
+		return errors.New("--ais-fragment-timeout must be at least 1ms")
+	}
+
+	input := make(chan *Message, 4096)
+	assembled := make(chan *Message, 4096)
+	sup.Add(assembleAIS(input, assembled, cli.AISFragmentTimeout))
+	tee := NewTee("main", assembled)
 	sup.Add(tee)
 
+	if cli.AdminSave && cli.Config == "" {
+		return errors.New("--admin-save requires --config")
+	}
+	if cli.AdminListen != "" && cli.AdminToken == "" && !adminLoopback(cli.AdminListen) {
+		return errors.New("--admin-token is required unless --admin-listen is a loopback address")
+	}
+	var pl *pipeline
+	if cli.Config != "" || cli.AdminListen != "" {
+		pl = newPipeline(input, tee, logger, cli.Config, cli.AdminSave)
+		sup.Add(pl)
+	}
+	var pipelineCfg *pipelineConfig
+	if cli.Config != "" {
+		cfg, err := loadPipelineConfig(cli.Config)
+		if err != nil {
+			return err
+		}
+		pipelineCfg = cfg
+	}
+
 	if cli.InputStdin {
 		logger.Info("Reading NMEA from stdin")
 		sup.Add(linesInto(input, os.Stdin, "stdin"))
@@ -71,66 +207,157 @@ func (cli *CLI) Run(ctx context.Context, logger *slog.Logger) error {
 		sup.Add(readTCPInto(input, addr))
 	}
 
-	for _, port := range cli.InputUDPListen {
-		logger.Info("Reading NMEA from UDP", "port", port)
-		sup.Add(readUDPInto(input, port))
+	for _, addr := range cli.InputTCPListen {
+		logger.Info("Accepting NMEA from incoming TCP connections", "addr", addr)
+		sup.Add(listenTCPInto(input, addr))
+	}
+
+	for _, spec := range cli.InputUDPListen {
+		udp, err := readUDPInto(input, spec)
+		if err != nil {
+			return err
+		}
+		logger.Info("Reading NMEA from UDP", "addr", spec)
+		sup.Add(udp)
 	}
 
 	for _, port := range cli.InputHTTPListen {
 		logger.Info("Reading NMEA from HTTP POST", "port", port)
-		sup.Add(readHTTPInto(input, port))
+		sup.Add(readHTTPInto(input, port, cli.InputHTTPToken))
 	}
 
-	for _, dev := range cli.InputSerial {
-		logger.Info("Reading NMEA from serial device", "dev", dev)
-		sup.Add(readSerialInto(input, dev))
+	for _, spec := range cli.InputSerial {
+		cfg, err := parseSerialConfig(spec)
+		if err != nil {
+			return err
+		}
+		logger.Info("Reading NMEA from serial device", "dev", cfg.dev, "config", cfg.String())
+		sup.Add(readSerialInto(input, cfg))
 	}
 
 	if cli.ForwardAllTCPListen != "" {
+		inject, err := newTCPInjector(cli.ForwardAllTCPInject, input, tee, cli.ForwardAllTCPInjectTo)
+		if err != nil {
+			return err
+		}
 		logger.Info("Forwarding NMEA to incoming connections", "addr", cli.ForwardAllTCPListen)
-		sup.Add(forwardTCP(tee.Output(), cli.ForwardAllTCPListen))
+		if inject != nil {
+			logger.Info("Accepting NMEA from forward clients", "addr", cli.ForwardAllTCPListen, "types", cli.ForwardAllTCPInject, "output", cli.ForwardAllTCPInjectTo)
+		}
+		sup.Add(forwardTCP(tee.FilteredOutput("tcp-all", filters["tcp-all"], teeDropOldest, 0), cli.ForwardAllTCPListen, cli.ForwardAllTCPStripTagBlock, decimators["tcp-all"], inject, cli.ForwardAllTCPReplayMaxAge))
 	}
 
 	if len(cli.ForwardUDPAll) > 0 {
 		logger.Info("Forwarding NMEA to UDP", "addrs", cli.ForwardUDPAll, ", ")
-		sup.Add(forwardUDP(tee.Output(), cli.ForwardUDPAll, cli.ForwardUDPAllMaxPacketSize, cli.ForwardUDPAllMaxDelay))
+		sup.Add(forwardUDP(tee.FilteredOutput("udp-all", filters["udp-all"], teeDropNewest, 0), cli.ForwardUDPAll, cli.ForwardUDPAllMaxPacketSize, cli.ForwardUDPAllMaxDelay, cli.ForwardUDPAllStripTagBlock, decimators["udp-all"]))
+	}
+
+	if cli.OutputSerial != "" {
+		cfg, err := parseSerialOutputConfig(cli.OutputSerial)
+		if err != nil {
+			return err
+		}
+		if err := checkSentenceTypes(cli.OutputSerialPriority); err != nil {
+			return err
+		}
+		logger.Info("Writing NMEA to serial device", "dev", cfg.dev, "config", cfg.String(), "priority", cli.OutputSerialPriority)
+		sup.Add(forwardSerial(tee.FilteredOutput("serial", filters["serial"], teeDropNewest, 0), cfg, cli.OutputSerialPriority, cli.OutputSerialMaxDelay, decimators["serial"]))
 	}
 
 	var ais *Tee
 
 	if len(cli.ForwardUDPAIS) > 0 {
 		if ais == nil {
-			ais = NewFilteredTee("AIS", tee.Output(), "!AI")
+			ais = NewFilteredTee("AIS", tee.Output("ais", teeDropNewest, 0), mustParseFilter("", "prefix:!AI"))
 			sup.Add(ais)
 		}
 		logger.Info("Forwarding AIS to UDP", "addrs", cli.ForwardUDPAIS)
-		sup.Add(forwardUDP(ais.Output(), cli.ForwardUDPAIS, cli.ForwardUDPAISMaxPacketSize, cli.ForwardUDPAISMaxDelay))
+		sup.Add(forwardUDP(ais.FilteredOutput("udp-ais", filters["udp-ais"], teeDropNewest, 0), cli.ForwardUDPAIS, cli.ForwardUDPAISMaxPacketSize, cli.ForwardUDPAISMaxDelay, cli.ForwardUDPAISStripTagBlock, decimators["udp-ais"]))
 	}
 
 	if cli.ForwardAISTCPListen != "" {
 		if ais == nil {
-			ais = NewFilteredTee("AIS", tee.Output(), "!AI")
+			ais = NewFilteredTee("AIS", tee.Output("ais", teeDropNewest, 0), mustParseFilter("", "prefix:!AI"))
 			sup.Add(ais)
 		}
 		logger.Info("Forwarding AIS to incoming connections ", "addr", cli.ForwardAISTCPListen)
-		sup.Add(forwardTCP(ais.Output(), cli.ForwardAISTCPListen))
+		sup.Add(forwardTCP(ais.FilteredOutput("tcp-ais", filters["tcp-ais"], teeDropOldest, 0), cli.ForwardAISTCPListen, cli.ForwardAISTCPStripTagBlock, decimators["tcp-ais"], nil, cli.ForwardAISTCPReplayMaxAge))
 	}
 
-	instruments := &instrumentsCollector{c: tee.Output()}
+	logger.Info("Tracking own position", "sources", cli.PositionSources)
+	ownShip := newOwnShip(tee.FilteredOutput("own-ship", filters["own-ship"], teeDropNewest, 0), cli.PositionSources, cli.PositionSourceTimeout, cli.AISOwnMMSI)
+	sup.Add(ownShip)
+
+	instruments := &instrumentsCollector{c: tee.FilteredOutput("instruments", filters["instruments"], teeDropNewest, 0), positions: ownShip.Output()}
 	sup.Add(instruments)
 
-	aisCounter := &aisContactsCounter{c: tee.Output()}
+	aisCounter := newAISContactsCounter(tee.FilteredOutput("ais-contacts", filters["ais-contacts"], teeDropNewest, 0), cli.AISContactWindows)
 	sup.Add(aisCounter)
 
+	aisTargets := newAISTargets(tee.FilteredOutput("ais-targets", filters["ais-targets"], teeDropNewest, 0), cli.AISTargetRetention)
+	sup.Add(aisTargets)
+
+	sup.Add(monitorAISAlerts(tee.FilteredOutput("ais-alerts", filters["ais-alerts"], teeDropNewest, 0), aisTargets, cli.AISAlertEventsFile, cli.AISAlertWebhook, cli.AISAlertExec, cli.AISAlertRepeat))
+
+	aisCoverage := newAISCoverage(tee.FilteredOutput("ais-coverage", filters["ais-coverage"], teeDropNewest, 0), ownShip)
+	sup.Add(aisCoverage)
+
+	if cli.AISRegistry != "" {
+		reg, err := aisregistry.Open(cli.AISRegistry)
+		if err != nil {
+			// Set the unreadable file aside and start over, rather than
+			// not starting at all.
+			backup := cli.AISRegistry + time.Now().UTC().Format(".bad-20060102-150405")
+			if rerr := os.Rename(cli.AISRegistry, backup); rerr != nil {
+				return err
+			}
+			logger.Error("Failed to load AIS registry, starting empty", "error", err, "backup", backup)
+			if reg, err = aisregistry.Open(cli.AISRegistry); err != nil {
+				return err
+			}
+		}
+		logger.Info("Recording AIS vessel registry", "file", cli.AISRegistry, "vessels", reg.Len())
+		sup.Add(recordAISRegistry(tee.FilteredOutput("ais-registry", filters["ais-registry"], teeDropNewest, 0), ownShip, reg, cli.AISRegistrySaveInterval))
+	}
+
+	handlers := map[string]http.HandlerFunc{
+		"/ais/targets":          aisTargets.ServeJSON,
+		"/ais/targets.geojson":  aisTargets.ServeGeoJSON,
+		"/ais/coverage.geojson": aisCoverage.ServeGeoJSON,
+	}
+
+	if cli.AISCPAAlarmDistance > 0 {
+		logger.Info("Monitoring AIS targets for CPA", "distance_nm", cli.AISCPAAlarmDistance, "time", cli.AISCPAAlarmTime, "emit", cli.AISCPAEmit)
+		cpa := newCPAMonitor(aisTargets, ownShip, cli.AISCPAAlarmDistance, cli.AISCPAAlarmTime, cli.AISCPAEmit, input)
+		sup.Add(cpa)
+		handlers["/ais/cpa"] = cpa.ServeJSON
+	}
+
+	if cli.AdminListen != "" {
+		admin := &adminAPI{pipeline: pl, services: sup.Services, token: cli.AdminToken}
+		url := &url.URL{Scheme: "http", Host: cli.AdminListen, Path: "/admin/services"}
+		logger.Info("Serving admin API", "url", url.String())
+		if cli.AdminListen == cli.PrometheusMetricsListen {
+			handlers["/admin/"] = admin.ServeHTTP
+		} else {
+			sup.Add(&adminListener{addr: cli.AdminListen, handler: admin})
+		}
+	}
+
 	if cli.PrometheusMetricsListen != "" {
 		url := &url.URL{Scheme: "http", Host: cli.PrometheusMetricsListen, Path: "/metrics"}
 		logger.Info("Exporting instruments and metrics", "url", url.String())
-		sup.Add(&prometheusListener{cli.PrometheusMetricsListen})
+		url.Path = "/ais/targets"
+		logger.Info("Exporting AIS targets", "url", url.String())
+		sup.Add(&prometheusListener{
+			addr:     cli.PrometheusMetricsListen,
+			handlers: handlers,
+		})
 	}
 
 	if cli.OutputRawPattern != "" {
 		logger.Info("Writing raw files", "pattern", cli.OutputRawPattern)
-		sup.Add(collectRAW(cli.OutputRawPattern, cli.OutputRawBufferSize, cli.OutputRawTimeWindow, cli.OutputRawFlushInterval, !cli.OutputRawUncompressed, tee.Output()))
+		sup.Add(collectRAW(cli.OutputRawPattern, cli.OutputRawBufferSize, cli.OutputRawTimeWindow, cli.OutputRawFlushInterval, !cli.OutputRawUncompressed, cli.OutputRawStripTagBlock, tee.FilteredOutput("raw", filters["raw"], teeBlock, 0)))
 	}
 
 	if cli.OutputGPXPattern != "" {
@@ -145,9 +372,40 @@ func (cli *CLI) Run(ctx context.Context, logger *slog.Logger) error {
 		}
 
 		logger.Info("Collecting GPX tracks", "pattern", cli.OutputGPXPattern)
-		nonAIS := NewFilteredTee("non-AIS", tee.Output(), "$")
-		sup.Add(nonAIS)
-		sup.Add(collectGPX(nonAIS.Output(), gpx, instruments))
+		sup.Add(collectGPX(ownShip.Output(), gpx, instruments))
+	}
+
+	if cli.OutputAISTrackPattern != "" {
+		format := writer.GPX
+		if filepath.Ext(cli.OutputAISTrackPattern) == ".geojson" {
+			format = writer.GeoJSON
+		}
+		newGPX := func(open func(time.Time) (io.WriteCloser, error)) *writer.AutoGPX {
+			return &writer.AutoGPX{
+				Opener:                open,
+				Format:                format,
+				SampleInterval:        cli.OutputAISTrackSampleInterval,
+				TriggerDistanceMeters: cli.OutputGPXMovingDistance,
+				TriggerTimeWindow:     cli.OutputGPXStartTimeWindow,
+				CooldownTimeWindow:    cli.OutputGPXStopTimeWindow,
+			}
+		}
+		logger.Info("Collecting AIS target tracks", "pattern", cli.OutputAISTrackPattern, "mmsi", cli.OutputAISTrackMMSI)
+		sup.Add(collectAISTracks(tee.FilteredOutput("ais-tracks", filters["ais-tracks"], teeDropNewest, 0), logger, cli.OutputAISTrackPattern, cli.OutputAISTrackMMSI, newGPX))
+	}
+
+	if pipelineCfg != nil {
+		// Applied last, as its names are checked against the other
+		// outputs of the main tee.
+		logger.Info("Running pipeline from configuration", "file", cli.Config, "inputs", len(pipelineCfg.Inputs), "tees", len(pipelineCfg.Tees), "outputs", len(pipelineCfg.Outputs))
+		if err := pl.Apply(pipelineCfg); err != nil {
+			return err
+		}
+		go pl.ReloadOnSignal(ctx)
+	}
+
+	if cli.ForwardAllTCPInjectTo != "" && !slices.Contains(tee.OutputNames(), cli.ForwardAllTCPInjectTo) {
+		return fmt.Errorf("--forward-all-tcp-inject-to: %q is not an output of the main tee", cli.ForwardAllTCPInjectTo)
 	}
 
 	return sup.Serve(ctx)
@@ -160,9 +418,12 @@ var gpxFilesCreatedTotal = promauto.NewCounter(prometheus.CounterOpts{
 })
 
 func newGPXFile(logger slog.Logger, pattern string, t time.Time) (io.WriteCloser, error) {
-	name := t.UTC().Format(pattern)
-	logger.Info("Creating new GPX track", "name", name)
 	gpxFilesCreatedTotal.Inc()
+	return createGPXFile(logger, t.UTC().Format(pattern))
+}
+
+func createGPXFile(logger slog.Logger, name string) (io.WriteCloser, error) {
+	logger.Info("Creating new GPX track", "name", name)
 	_ = os.MkdirAll(filepath.Dir(name), 0o755)
 	return os.Create(name)
 }
@@ -0,0 +1,21 @@
+package serve
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// bindToDeviceControl returns a socket control function that binds the
+// socket to the named network interface.
+func bindToDeviceControl(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		if err := c.Control(func(fd uintptr) {
+			serr = unix.BindToDevice(int(fd), iface)
+		}); err != nil {
+			return err
+		}
+		return serr
+	}
+}
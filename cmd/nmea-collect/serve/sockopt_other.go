@@ -0,0 +1,14 @@
+//go:build !linux
+
+package serve
+
+import (
+	"errors"
+	"syscall"
+)
+
+func bindToDeviceControl(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.New("binding to an interface is only supported on Linux")
+	}
+}
@@ -0,0 +1,117 @@
+package serve
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	nmea "github.com/adrianmo/go-nmea"
+)
+
+// tagBlock is an NMEA 4.x tag block, as prefixed to a sentence like
+// `\s:r3669961,c:1690000000*6B\!AIVDM,...`.
+type tagBlock struct {
+	Source       string    // s: source identification
+	Destination  string    // d: destination identification
+	Time         time.Time // c: receive time
+	RelativeTime int64     // r: relative time
+	LineCount    int64     // n: line count
+	Text         string    // t: text string
+	Group        tagGroup  // g: sentence grouping
+}
+
+// tagGroup is the sentence grouping parameter, identifying sentence
+// Seq of Total in the group with the given ID.
+type tagGroup struct {
+	Seq   int
+	Total int
+	ID    int
+}
+
+// Unix times larger than this are taken to be in milliseconds.
+const tagBlockMaxUnixSeconds = 1e11
+
+// splitTagBlock separates a leading tag block from the sentence. The tag
+// block is nil when the line doesn't have one.
+func splitTagBlock(line string) (*tagBlock, string, error) {
+	if !strings.HasPrefix(line, `\`) {
+		return nil, line, nil
+	}
+	end := strings.IndexByte(line[1:], '\\')
+	if end == -1 {
+		return nil, line, errors.New("unterminated tag block")
+	}
+	tb, err := parseTagBlock(line[1 : end+1])
+	if err != nil {
+		return nil, line, err
+	}
+	return tb, line[end+2:], nil
+}
+
+// parseTagBlock parses the tag block contents between the backslashes,
+// including the checksum.
+func parseTagBlock(s string) (*tagBlock, error) {
+	idx := strings.LastIndexByte(s, '*')
+	if idx == -1 {
+		return nil, errors.New("tag block without checksum")
+	}
+	if chk := nmea.Checksum(s[:idx]); chk != strings.ToUpper(s[idx+1:]) {
+		return nil, fmt.Errorf("tag block checksum mismatch (%s != %s)", s[idx+1:], chk)
+	}
+
+	var tb tagBlock
+	for _, field := range strings.Split(s[:idx], ",") {
+		key, val, ok := strings.Cut(field, ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed tag block field %q", field)
+		}
+		var err error
+		switch key {
+		case "s":
+			tb.Source = val
+		case "d":
+			tb.Destination = val
+		case "t":
+			tb.Text = val
+		case "c":
+			var v int64
+			v, err = strconv.ParseInt(val, 10, 64)
+			if v > tagBlockMaxUnixSeconds {
+				tb.Time = time.UnixMilli(v)
+			} else {
+				tb.Time = time.Unix(v, 0)
+			}
+		case "r":
+			tb.RelativeTime, err = strconv.ParseInt(val, 10, 64)
+		case "n":
+			tb.LineCount, err = strconv.ParseInt(val, 10, 64)
+		case "g":
+			tb.Group, err = parseTagGroup(val)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("tag block field %q: %w", field, err)
+		}
+	}
+	return &tb, nil
+}
+
+func parseTagGroup(s string) (tagGroup, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 3 {
+		return tagGroup{}, errors.New("malformed grouping")
+	}
+	var g tagGroup
+	var err error
+	if g.Seq, err = strconv.Atoi(parts[0]); err != nil {
+		return tagGroup{}, err
+	}
+	if g.Total, err = strconv.Atoi(parts[1]); err != nil {
+		return tagGroup{}, err
+	}
+	if g.ID, err = strconv.Atoi(parts[2]); err != nil {
+		return tagGroup{}, err
+	}
+	return g, nil
+}
@@ -0,0 +1,68 @@
+package serve
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSplitTagBlock(t *testing.T) {
+	line := `\g:1-2-73874,n:157036,s:r003669945,c:1241544035*4A\!AIVDM,1,1,,B,15N4cJ005Jrek0H@9nDW5608EP8V,0*7D`
+	tb, sentence, err := splitTagBlock(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sentence != `!AIVDM,1,1,,B,15N4cJ005Jrek0H@9nDW5608EP8V,0*7D` {
+		t.Error("bad sentence", sentence)
+	}
+	if tb.Source != "r003669945" {
+		t.Error("bad source", tb.Source)
+	}
+	if !tb.Time.Equal(time.Unix(1241544035, 0)) {
+		t.Error("bad time", tb.Time)
+	}
+	if tb.LineCount != 157036 {
+		t.Error("bad line count", tb.LineCount)
+	}
+	if tb.Group != (tagGroup{Seq: 1, Total: 2, ID: 73874}) {
+		t.Error("bad grouping", tb.Group)
+	}
+}
+
+func TestSplitTagBlockErrors(t *testing.T) {
+	cases := []string{
+		`\s:r003669945,c:1241544035\!AIVDM,1,1,,B,15N4cJ005Jrek0H@9nDW5608EP8V,0*7D`,
+		`\s:r003669945,c:1241544035*00\!AIVDM,1,1,,B,15N4cJ005Jrek0H@9nDW5608EP8V,0*7D`,
+		`\s:r003669945,c:1241544035*4A!AIVDM,1,1,,B,15N4cJ005Jrek0H@9nDW5608EP8V,0*7D`,
+	}
+	for _, line := range cases {
+		if _, _, err := splitTagBlock(line); err == nil {
+			t.Errorf("splitTagBlock(%q) should fail", line)
+		}
+	}
+
+	tb, sentence, err := splitTagBlock("$YDHDG,58.8,0.0,E,4.3,E*66")
+	if err != nil || tb != nil || sentence != "$YDHDG,58.8,0.0,E,4.3,E*66" {
+		t.Error("unexpected result for line without tag block")
+	}
+}
+
+func TestAcceptLineTagBlock(t *testing.T) {
+	line := `\g:1-2-73874,n:157036,s:r003669945,c:1241544035*4A\!AIVDM,1,1,,B,15N4cJ005Jrek0H@9nDW5608EP8V,0*7D`
+	msg := acceptLine("test", line)
+	if msg == nil {
+		t.Fatal("line should be accepted")
+	}
+	if msg.Raw != `!AIVDM,1,1,,B,15N4cJ005Jrek0H@9nDW5608EP8V,0*7D` {
+		t.Error("bad sentence", msg.Raw)
+	}
+	if msg.Line() != line {
+		t.Error("bad line", msg.Line())
+	}
+	if !msg.Time().Equal(time.Unix(1241544035, 0)) {
+		t.Error("bad time", msg.Time())
+	}
+
+	if acceptLine("test", `\s:r003669945*00\!AIVDM,1,1,,B,15N4cJ005Jrek0H@9nDW5608EP8V,0*7D`) != nil {
+		t.Error("line with bad tag block should be rejected")
+	}
+}
@@ -0,0 +1,290 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/exp/slices"
+)
+
+const teeBufferSize = 4096
+
+var (
+	nmeaMessagesTeeRead = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nmea",
+		Subsystem: "tee",
+		Name:      "messages_input_total",
+	}, []string{"tee"})
+	nmeaMessagesTeeSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nmea",
+		Subsystem: "tee",
+		Name:      "messages_output_total",
+	}, []string{"tee"})
+	nmeaMessagesTeeFilterSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nmea",
+		Subsystem: "tee",
+		Name:      "messages_filter_skipped_total",
+	}, []string{"tee"})
+	nmeaMessagesTeeDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nmea",
+		Subsystem: "tee",
+		Name:      "messages_dropped_total",
+	}, []string{"tee", "output"})
+	nmeaTeeOutputDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nmea",
+		Subsystem: "tee",
+		Name:      "output_depth",
+	}, []string{"tee", "output"})
+)
+
+// teePolicy decides what happens when an output's buffer is full.
+type teePolicy int
+
+const (
+	// teeDropNewest discards the message that doesn't fit.
+	teeDropNewest teePolicy = iota
+	// teeDropOldest discards the oldest buffered message to make room,
+	// so that a slow consumer sees recent data.
+	teeDropOldest
+	// teeBlock waits for the consumer, holding up the tee and thereby
+	// every other output. Only for consumers that must be lossless and
+	// are expected to keep up.
+	teeBlock
+)
+
+var teePolicyNames = map[teePolicy]string{
+	teeDropNewest: "drop-newest",
+	teeDropOldest: "drop-oldest",
+	teeBlock:      "block",
+}
+
+func (p teePolicy) String() string {
+	if s, ok := teePolicyNames[p]; ok {
+		return s
+	}
+	return fmt.Sprintf("teePolicy(%d)", int(p))
+}
+
+func parseTeePolicy(s string) (teePolicy, error) {
+	for p, name := range teePolicyNames {
+		if s == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown backpressure policy %q (want block, drop-newest or drop-oldest)", s)
+}
+
+type teeOutput struct {
+	name   string
+	filter *messageFilter
+	policy teePolicy
+	c      chan *Message
+	done   chan struct{} // closed when the output is removed
+	sent   *atomic.Uint64
+	drops  *atomic.Uint64
+}
+
+// teeOutputStats describes the state of an output.
+type teeOutputStats struct {
+	Policy   string `json:"policy"`
+	Depth    int    `json:"depth"`
+	Capacity int    `json:"capacity"`
+	Sent     uint64 `json:"sent"`
+	Dropped  uint64 `json:"dropped"`
+}
+
+type Tee struct {
+	name   string
+	input  <-chan *Message
+	filter *messageFilter
+
+	mut     sync.Mutex
+	outputs []teeOutput // replaced, never modified, on changes
+}
+
+func NewTee(name string, input <-chan *Message) *Tee {
+	return &Tee{name: name, input: input}
+}
+
+func NewFilteredTee(name string, input <-chan *Message, filter *messageFilter) *Tee {
+	return &Tee{name: name, input: input, filter: filter}
+}
+
+func (t *Tee) String() string {
+	if t.filter == nil {
+		return fmt.Sprintf("nmea-tee@%p", t)
+	}
+	return fmt.Sprintf("nmea-tee(%q)@%p", t.filter, t)
+}
+
+// Output returns a new output channel with the given name, used in
+// metrics, buffer size and behavior when the buffer is full. A zero size
+// means the default buffer size. Outputs may be added while the tee is
+// running.
+func (t *Tee) Output(name string, policy teePolicy, size int) <-chan *Message {
+	return t.FilteredOutput(name, nil, policy, size)
+}
+
+// FilteredOutput is like Output, for only the messages passing the filter.
+func (t *Tee) FilteredOutput(name string, filter *messageFilter, policy teePolicy, size int) <-chan *Message {
+	if size <= 0 {
+		size = teeBufferSize
+	}
+	c := make(chan *Message, size)
+	out := teeOutput{
+		name:   name,
+		filter: filter,
+		policy: policy,
+		c:      c,
+		done:   make(chan struct{}),
+		sent:   new(atomic.Uint64),
+		drops:  new(atomic.Uint64),
+	}
+	t.mut.Lock()
+	t.outputs = append(slices.Clip(t.outputs), out)
+	t.mut.Unlock()
+	nmeaMessagesTeeDropped.WithLabelValues(t.name, name)
+	nmeaTeeOutputDepth.WithLabelValues(t.name, name)
+	return c
+}
+
+// OutputStats returns the current state of the output channel.
+func (t *Tee) OutputStats(c <-chan *Message) (teeOutputStats, bool) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	for _, out := range t.outputs {
+		if out.c == c {
+			return teeOutputStats{
+				Policy:   out.policy.String(),
+				Depth:    len(out.c),
+				Capacity: cap(out.c),
+				Sent:     out.sent.Load(),
+				Dropped:  out.drops.Load(),
+			}, true
+		}
+	}
+	return teeOutputStats{}, false
+}
+
+// OutputNames returns the names of the current outputs.
+func (t *Tee) OutputNames() []string {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	names := make([]string, len(t.outputs))
+	for i, out := range t.outputs {
+		names[i] = out.name
+	}
+	return names
+}
+
+// RemoveOutput stops sending to the output channel. The channel isn't
+// closed, as the receiver may still be selecting on it.
+func (t *Tee) RemoveOutput(c <-chan *Message) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	outputs := make([]teeOutput, 0, len(t.outputs))
+	for _, out := range t.outputs {
+		if out.c == c {
+			close(out.done)
+			nmeaMessagesTeeDropped.DeleteLabelValues(t.name, out.name)
+			nmeaTeeOutputDepth.DeleteLabelValues(t.name, out.name)
+			continue
+		}
+		outputs = append(outputs, out)
+	}
+	t.outputs = outputs
+}
+
+// Inject sends the message to the named output only, bypassing the tee's
+// input and filters but respecting the output's policy. It returns false
+// if there is no such output.
+func (t *Tee) Inject(ctx context.Context, name string, msg *Message) (bool, error) {
+	t.mut.Lock()
+	outputs := t.outputs
+	t.mut.Unlock()
+	for _, out := range outputs {
+		if out.name == name {
+			return true, t.send(ctx, out, msg)
+		}
+	}
+	return false, nil
+}
+
+func (t *Tee) Serve(ctx context.Context) error {
+	for {
+		select {
+		case msg := <-t.input:
+			nmeaMessagesTeeRead.WithLabelValues(t.name).Inc()
+			if !t.filter.Match(msg) {
+				nmeaMessagesTeeFilterSkipped.WithLabelValues(t.name).Inc()
+				continue
+			}
+			t.mut.Lock()
+			outputs := t.outputs
+			t.mut.Unlock()
+			for _, out := range outputs {
+				if !out.filter.Match(msg) {
+					continue
+				}
+				if err := t.send(ctx, out, msg); err != nil {
+					return err
+				}
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (t *Tee) send(ctx context.Context, out teeOutput, msg *Message) error {
+	defer nmeaTeeOutputDepth.WithLabelValues(t.name, out.name).Set(float64(len(out.c)))
+
+	select {
+	case out.c <- msg:
+		nmeaMessagesTeeSent.WithLabelValues(t.name).Inc()
+		out.sent.Add(1)
+		return nil
+	default:
+	}
+
+	switch out.policy {
+	case teeBlock:
+		select {
+		case out.c <- msg:
+			nmeaMessagesTeeSent.WithLabelValues(t.name).Inc()
+			out.sent.Add(1)
+			return nil
+		case <-out.done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+	case teeDropOldest:
+		for {
+			select {
+			case <-out.c:
+				nmeaMessagesTeeDropped.WithLabelValues(t.name, out.name).Inc()
+				out.drops.Add(1)
+			default:
+				// The consumer emptied the buffer meanwhile.
+			}
+			select {
+			case out.c <- msg:
+				nmeaMessagesTeeSent.WithLabelValues(t.name).Inc()
+				out.sent.Add(1)
+				return nil
+			default:
+			}
+		}
+
+	default:
+		nmeaMessagesTeeDropped.WithLabelValues(t.name, out.name).Inc()
+		out.drops.Add(1)
+		return nil
+	}
+}
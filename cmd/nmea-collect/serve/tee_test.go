@@ -0,0 +1,73 @@
+package serve
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTeePolicies(t *testing.T) {
+	tee := NewTee("test", nil)
+	tee.Output("newest", teeDropNewest, 2)
+	tee.Output("oldest", teeDropOldest, 2)
+
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		for _, out := range tee.outputs {
+			if err := tee.send(ctx, out, &Message{Raw: strconv.Itoa(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	expect := func(out teeOutput, want ...string) {
+		t.Helper()
+		if len(out.c) != len(want) {
+			t.Fatalf("%s: %d buffered, want %d", out.name, len(out.c), len(want))
+		}
+		for _, w := range want {
+			if msg := <-out.c; msg.Raw != w {
+				t.Errorf("%s: got %q, want %q", out.name, msg.Raw, w)
+			}
+		}
+	}
+	expect(tee.outputs[0], "0", "1")
+	expect(tee.outputs[1], "3", "4")
+}
+
+func TestTeeBlock(t *testing.T) {
+	input := make(chan *Message)
+	tee := NewTee("test", input)
+	block := tee.Output("block", teeBlock, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = tee.Serve(ctx) }()
+
+	input <- &Message{Raw: "0"}
+	input <- &Message{Raw: "1"}
+	select {
+	case input <- &Message{Raw: "2"}:
+		t.Fatal("tee should block on a full output")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for i := 0; i < 2; i++ {
+		if msg := <-block; msg.Raw != strconv.Itoa(i) {
+			t.Errorf("got %q, want %d", msg.Raw, i)
+		}
+	}
+}
+
+func TestParseTeePolicy(t *testing.T) {
+	for _, p := range []teePolicy{teeBlock, teeDropNewest, teeDropOldest} {
+		got, err := parseTeePolicy(p.String())
+		if err != nil || got != p {
+			t.Errorf("parseTeePolicy(%q) = %v, %v", p.String(), got, err)
+		}
+	}
+	if _, err := parseTeePolicy("drop-random"); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+}
@@ -0,0 +1,290 @@
+// Package aisregistry is a durable record of every AIS vessel seen,
+// stored as a JSON file.
+package aisregistry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+const fileVersion = 1
+
+// Vessel is what the registry knows about one MMSI.
+type Vessel struct {
+	MMSI        uint32        `json:"mmsi"`
+	Class       string        `json:"class,omitempty"`
+	Names       []NameHistory `json:"names,omitempty"`
+	CallSigns   []NameHistory `json:"call_signs,omitempty"`
+	FirstSeen   time.Time     `json:"first_seen"`
+	LastSeen    time.Time     `json:"last_seen"`
+	Messages    uint64        `json:"messages"`
+	ClosestNM   *float64      `json:"closest_nm,omitempty"`
+	ClosestTime time.Time     `json:"closest_time,omitempty"`
+	MaxRangeNM  float64       `json:"max_range_nm,omitempty"`
+}
+
+// NameHistory is a name or call sign and when it was used.
+type NameHistory struct {
+	Value     string    `json:"value"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// Name returns the most recently seen name, or an empty string.
+func (v *Vessel) Name() string {
+	return latest(v.Names)
+}
+
+// CallSign returns the most recently seen call sign, or an empty string.
+func (v *Vessel) CallSign() string {
+	return latest(v.CallSigns)
+}
+
+// Matches returns true if the query is part of the MMSI or any name or
+// call sign the vessel has had, ignoring case.
+func (v *Vessel) Matches(query string) bool {
+	query = strings.ToUpper(query)
+	if strings.Contains(strconv.FormatUint(uint64(v.MMSI), 10), query) {
+		return true
+	}
+	for _, hs := range [][]NameHistory{v.Names, v.CallSigns} {
+		for _, h := range hs {
+			if strings.Contains(strings.ToUpper(h.Value), query) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (v *Vessel) clone() Vessel {
+	c := *v
+	c.Names = slices.Clone(v.Names)
+	c.CallSigns = slices.Clone(v.CallSigns)
+	if v.ClosestNM != nil {
+		closest := *v.ClosestNM
+		c.ClosestNM = &closest
+	}
+	return c
+}
+
+type file struct {
+	Version int       `json:"version"`
+	Saved   time.Time `json:"saved"`
+	Vessels []Vessel  `json:"vessels"`
+}
+
+// Registry is the set of vessels, loaded from and saved to a file. It is
+// safe for concurrent use.
+type Registry struct {
+	path string
+
+	mut     sync.Mutex
+	vessels map[uint32]*Vessel
+	dirty   bool
+}
+
+// Open loads the registry from the given file. A file that doesn't exist
+// yet gives an empty registry.
+func Open(path string) (*Registry, error) {
+	r := &Registry{path: path, vessels: make(map[uint32]*Vessel)}
+
+	bs, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return r, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var f file
+	if err := json.Unmarshal(bs, &f); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if f.Version != fileVersion {
+		return nil, fmt.Errorf("%s: unsupported version %d", path, f.Version)
+	}
+	for i := range f.Vessels {
+		r.vessels[f.Vessels[i].MMSI] = &f.Vessels[i]
+	}
+	return r, nil
+}
+
+// Save writes the registry to disk, if anything changed since it was
+// loaded or last saved. The file is replaced atomically. If writing
+// fails the registry remains dirty, to be saved on the next attempt.
+func (r *Registry) Save() error {
+	r.mut.Lock()
+	if !r.dirty {
+		r.mut.Unlock()
+		return nil
+	}
+	f := file{Version: fileVersion, Saved: time.Now().UTC(), Vessels: r.snapshot()}
+	r.dirty = false
+	r.mut.Unlock()
+
+	if err := r.write(f); err != nil {
+		r.mut.Lock()
+		r.dirty = true
+		r.mut.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (r *Registry) write(f file) error {
+	bs, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	_ = os.MkdirAll(filepath.Dir(r.path), 0o755)
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), filepath.Base(r.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(bs); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), r.path)
+}
+
+// Vessels returns a copy of all vessels, ordered by MMSI.
+func (r *Registry) Vessels() []Vessel {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return r.snapshot()
+}
+
+// Len returns the number of vessels in the registry.
+func (r *Registry) Len() int {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return len(r.vessels)
+}
+
+// Vessel returns a copy of the given vessel, if known.
+func (r *Registry) Vessel(mmsi uint32) (Vessel, bool) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	v, ok := r.vessels[mmsi]
+	if !ok {
+		return Vessel{}, false
+	}
+	return v.clone(), true
+}
+
+func (r *Registry) snapshot() []Vessel {
+	res := make([]Vessel, 0, len(r.vessels))
+	for _, v := range r.vessels {
+		res = append(res, v.clone())
+	}
+	slices.SortFunc(res, func(a, b Vessel) bool {
+		return a.MMSI < b.MMSI
+	})
+	return res
+}
+
+// Seen records a message from the vessel.
+func (r *Registry) Seen(mmsi uint32, class string, when time.Time) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	v := r.vessel(mmsi, when)
+	v.Messages++
+	if class != "" {
+		v.Class = class
+	}
+}
+
+// SetName records the vessel's name.
+func (r *Registry) SetName(mmsi uint32, name string, when time.Time) {
+	if name == "" {
+		return
+	}
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	v := r.vessel(mmsi, when)
+	v.Names = record(v.Names, name, when)
+}
+
+// SetCallSign records the vessel's call sign.
+func (r *Registry) SetCallSign(mmsi uint32, callSign string, when time.Time) {
+	if callSign == "" {
+		return
+	}
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	v := r.vessel(mmsi, when)
+	v.CallSigns = record(v.CallSigns, callSign, when)
+}
+
+// ObserveRange records the distance from us to the vessel, in nautical
+// miles, keeping track of the closest approach and the maximum range.
+func (r *Registry) ObserveRange(mmsi uint32, rng float64, when time.Time) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	v := r.vessel(mmsi, when)
+	if v.ClosestNM == nil || rng < *v.ClosestNM {
+		v.ClosestNM = &rng
+		v.ClosestTime = when
+	}
+	if rng > v.MaxRangeNM {
+		v.MaxRangeNM = rng
+	}
+}
+
+// vessel returns the vessel, creating it if necessary, and updates the
+// seen times. The caller must hold the lock.
+func (r *Registry) vessel(mmsi uint32, when time.Time) *Vessel {
+	r.dirty = true
+	v, ok := r.vessels[mmsi]
+	if !ok {
+		v = &Vessel{MMSI: mmsi, FirstSeen: when, LastSeen: when}
+		r.vessels[mmsi] = v
+	}
+	if when.Before(v.FirstSeen) {
+		v.FirstSeen = when
+	}
+	if when.After(v.LastSeen) {
+		v.LastSeen = when
+	}
+	return v
+}
+
+// record adds the value to the history, or updates the last seen time if
+// it's the current value.
+func record(hist []NameHistory, value string, when time.Time) []NameHistory {
+	if len(hist) > 0 && hist[len(hist)-1].Value == value {
+		if when.After(hist[len(hist)-1].LastSeen) {
+			hist[len(hist)-1].LastSeen = when
+		}
+		return hist
+	}
+	return append(hist, NameHistory{Value: value, FirstSeen: when, LastSeen: when})
+}
+
+func latest(hist []NameHistory) string {
+	if len(hist) == 0 {
+		return ""
+	}
+	return hist[len(hist)-1].Value
+}
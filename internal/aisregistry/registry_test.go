@@ -0,0 +1,77 @@
+package aisregistry
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRegistrySaveOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	reg, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t0 := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	reg.Seen(123456789, "A", t0)
+	reg.SetName(123456789, "FIRST NAME", t0)
+	reg.ObserveRange(123456789, 12.5, t0)
+	reg.Seen(123456789, "A", t0.Add(time.Hour))
+	reg.SetName(123456789, "SECOND NAME", t0.Add(time.Hour))
+	reg.SetCallSign(123456789, "SABC", t0.Add(time.Hour))
+	reg.ObserveRange(123456789, 2.5, t0.Add(time.Hour))
+	reg.ObserveRange(123456789, 7.5, t0.Add(2*time.Hour))
+	reg.Seen(234567890, "B", t0)
+
+	if err := reg.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.Len() != 2 {
+		t.Fatalf("expected two vessels, got %d", reg.Len())
+	}
+	v, ok := reg.Vessel(123456789)
+	if !ok {
+		t.Fatal("vessel missing")
+	}
+	if v.Messages != 2 || !v.FirstSeen.Equal(t0) || !v.LastSeen.Equal(t0.Add(2*time.Hour)) {
+		t.Errorf("unexpected counters: %+v", v)
+	}
+	if v.Name() != "SECOND NAME" || len(v.Names) != 2 || v.CallSign() != "SABC" {
+		t.Errorf("unexpected names: %+v", v)
+	}
+	if v.ClosestNM == nil || *v.ClosestNM != 2.5 || !v.ClosestTime.Equal(t0.Add(time.Hour)) || v.MaxRangeNM != 12.5 {
+		t.Errorf("unexpected ranges: %+v", v)
+	}
+	if !v.Matches("first") || !v.Matches("4567") || v.Matches("other") {
+		t.Error("unexpected search result")
+	}
+}
+
+func TestRegistrySaveFailure(t *testing.T) {
+	dir := t.TempDir()
+	notDir := filepath.Join(dir, "file")
+	if err := os.WriteFile(notDir, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	reg := &Registry{path: filepath.Join(notDir, "registry.json"), vessels: make(map[uint32]*Vessel)}
+	reg.Seen(123456789, "A", time.Now())
+	if err := reg.Save(); err == nil {
+		t.Fatal("expected save to fail")
+	}
+
+	// The changes are still there to be saved once that's possible.
+	reg.path = filepath.Join(dir, "registry.json")
+	if err := reg.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(reg.path); err != nil {
+		t.Error("registry not saved:", err)
+	}
+}
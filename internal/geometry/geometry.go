@@ -32,6 +32,50 @@ func Bearing(lat1, lon1, lat2, lon2 float64) float64 {
 	return v
 }
 
+// Destination returns the point reached when travelling the given
+// distance, in nautical miles, on the given bearing, in degrees.
+func Destination(lat, lon, bearing, distance float64) (float64, float64) {
+	lat *= math.Pi / 180
+	lon *= math.Pi / 180
+	bearing *= math.Pi / 180
+	d := distance / 60 * math.Pi / 180
+	lat2 := math.Asin(math.Sin(lat)*math.Cos(d) + math.Cos(lat)*math.Sin(d)*math.Cos(bearing))
+	lon2 := lon + math.Atan2(math.Sin(bearing)*math.Sin(d)*math.Cos(lat), math.Cos(d)-math.Sin(lat)*math.Sin(lat2))
+	lon2 = math.Mod(lon2+3*math.Pi, 2*math.Pi) - math.Pi
+	return lat2 * 180 / math.Pi, lon2 * 180 / math.Pi
+}
+
+// CPA returns the closest point of approach between two vessels, given
+// their positions, speeds in knots and courses in degrees. The distance
+// at the closest point is returned in nautical miles and the time until
+// it is reached in hours. The time is negative if the closest point has
+// already passed, and zero if the vessels aren't moving relative to each
+// other. The calculation uses a flat earth approximation around the first
+// vessel, which is fine for the distances involved in collision
+// avoidance.
+func CPA(lat1, lon1, sog1, cog1, lat2, lon2, sog2, cog2 float64) (cpa, tcpa float64) {
+	dlon := lon2 - lon1
+	if dlon > 180 {
+		dlon -= 360
+	} else if dlon < -180 {
+		dlon += 360
+	}
+
+	// Relative position and velocity of vessel 2, in nautical miles and
+	// knots, x pointing east and y north.
+	x := dlon * 60 * math.Cos(lat1*math.Pi/180)
+	y := (lat2 - lat1) * 60
+	vx := sog2*math.Sin(cog2*math.Pi/180) - sog1*math.Sin(cog1*math.Pi/180)
+	vy := sog2*math.Cos(cog2*math.Pi/180) - sog1*math.Cos(cog1*math.Pi/180)
+
+	v2 := vx*vx + vy*vy
+	if v2 < 1e-9 {
+		return math.Hypot(x, y), 0
+	}
+	tcpa = -(x*vx + y*vy) / v2
+	return math.Hypot(x+vx*tcpa, y+vy*tcpa), tcpa
+}
+
 func CardinalDirection(degrees int) string {
 	if degrees < 23 {
 		return "N"
@@ -1,6 +1,7 @@
 package geometry
 
 import (
+	"math"
 	"testing"
 )
 
@@ -50,3 +51,48 @@ func TestDistance(t *testing.T) {
 		}
 	}
 }
+
+func TestDestination(t *testing.T) {
+	cases := []struct {
+		lat, lon         float64
+		bearing, dist    float64
+		wantLat, wantLon float64
+	}{
+		{0, 0, 0, 0, 0, 0},
+		{0, 0, 0, 60, 1, 0},
+		{0, 0, 90, 60, 0, 1},
+		{0, 0, 180, 60, -1, 0},
+		{0, 179.5, 90, 60, 0, -179.5},
+		{57, 11, 45, 10, 57.118, 11.218},
+	}
+
+	for _, c := range cases {
+		lat, lon := Destination(c.lat, c.lon, c.bearing, c.dist)
+		if math.Abs(lat-c.wantLat) > 0.01 || math.Abs(lon-c.wantLon) > 0.01 {
+			t.Errorf("Destination(%f, %f, %f, %f) == %f, %f, want %f, %f", c.lat, c.lon, c.bearing, c.dist, lat, lon, c.wantLat, c.wantLon)
+		}
+	}
+}
+
+func TestCPA(t *testing.T) {
+	cases := []struct {
+		name                 string
+		lat1, lon1, sog, cog float64
+		lat2, lon2, sog2, c2 float64
+		cpa, tcpa            float64
+	}{
+		{"head on", 0, 0, 10, 0, 1, 0, 10, 180, 0, 3},
+		{"crossing", 0, 0, 10, 0, 0, -0.1, 10, 90, 4.24, 0.3},
+		{"parallel", 0, 0, 10, 0, 0, 0.1, 10, 0, 6, 0},
+		{"overtaking", 0, 0, 5, 0, -0.1, 0.01, 10, 0, 0.6, 1.2},
+		{"diverging", 0, 0, 10, 0, -0.1, 0.1, 10, 180, 6, -0.3},
+		{"stationary target", 0, 0, 6, 90, 0, 0.1, 0, 0, 0, 1},
+	}
+
+	for _, c := range cases {
+		cpa, tcpa := CPA(c.lat1, c.lon1, c.sog, c.cog, c.lat2, c.lon2, c.sog2, c.c2)
+		if math.Abs(cpa-c.cpa) > 0.01 || math.Abs(tcpa-c.tcpa) > 0.01 {
+			t.Errorf("%s: CPA == %f, %f, want %f, %f", c.name, cpa, tcpa, c.cpa, c.tcpa)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package writer
 
 import (
+	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"io"
 	"sort"
@@ -16,8 +18,21 @@ const (
 	NamespaceURL = "https://calmh.dev/nmea-collect/"
 )
 
+// Format is the file format of the tracks.
+type Format int
+
+const (
+	// GPX tracks, the default.
+	GPX Format = iota
+	// GeoJSON tracks, as a LineString feature with the point times in the
+	// coordTimes property. Extensions aren't written.
+	GeoJSON
+)
+
 type AutoGPX struct {
 	Opener                func(time.Time) (io.WriteCloser, error)
+	Format                Format
+	Name                  string // written as the track name in new files, if set
 	SampleInterval        time.Duration
 	TriggerDistanceMeters float64
 	TriggerTimeWindow     time.Duration
@@ -25,6 +40,7 @@ type AutoGPX struct {
 
 	samples     []sample
 	destination io.WriteCloser
+	times       []string // point times of the GeoJSON track being written
 }
 
 type sample struct {
@@ -102,14 +118,22 @@ func (g *AutoGPX) startRecording(t time.Time) {
 		return
 	}
 	g.destination = fd
+	g.times = nil
 
 	header := fmt.Sprintf(`<gpx xmlns="http://www.topografix.com/GPX/1/1" xmlns:%s="%s"><trk><trkseg>`, Namespace, NamespaceURL)
+	if g.Format == GeoJSON {
+		header = `{"type":"Feature","geometry":{"type":"LineString","coordinates":[`
+	} else if g.Name != "" {
+		var name strings.Builder
+		_ = xml.EscapeText(&name, []byte(g.Name))
+		header = fmt.Sprintf(`<gpx xmlns="http://www.topografix.com/GPX/1/1" xmlns:%s="%s"><metadata><name>%s</name></metadata><trk><name>%s</name><trkseg>`, Namespace, NamespaceURL, name.String(), name.String())
+	}
 	if _, err := fmt.Fprintln(g.destination, header); err != nil {
 		slog.Error("Writing to file", "error", err)
 		return
 	}
 	for _, s := range g.samples {
-		if _, err := fmt.Fprintln(g.destination, s.gpx()); err != nil {
+		if err := g.write(s); err != nil {
 			slog.Error("Writing to file", "error", err)
 			return
 		}
@@ -117,13 +141,37 @@ func (g *AutoGPX) startRecording(t time.Time) {
 }
 
 func (g *AutoGPX) record(s sample) {
-	if _, err := fmt.Fprintln(g.destination, s.gpx()); err != nil {
+	if err := g.write(s); err != nil {
 		slog.Error("Writing to file", "error", err)
 	}
 }
 
+// write writes the sample as a track point. For GeoJSON the time is kept
+// until the end, as the times are written after the coordinates.
+func (g *AutoGPX) write(s sample) error {
+	if g.Format != GeoJSON {
+		_, err := fmt.Fprintln(g.destination, s.gpx())
+		return err
+	}
+	sep := ""
+	if len(g.times) > 0 {
+		sep = ","
+	}
+	g.times = append(g.times, s.when.UTC().Format(time.RFC3339))
+	_, err := fmt.Fprintf(g.destination, "%s[%f,%f]\n", sep, s.lon, s.lat)
+	return err
+}
+
 func (g *AutoGPX) stopRecording() {
 	footer := `</trkseg></trk></gpx>`
+	if g.Format == GeoJSON {
+		props, _ := json.Marshal(struct {
+			Name       string   `json:"name,omitempty"`
+			CoordTimes []string `json:"coordTimes"`
+		}{g.Name, g.times})
+		footer = `]},"properties":` + string(props) + `}`
+		g.times = nil
+	}
 	if _, err := fmt.Fprintln(g.destination, footer); err != nil {
 		slog.Error("Writing to file", "error", err)
 	}